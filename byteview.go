@@ -2,9 +2,12 @@ package cache
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
 	"strings"
+	"unsafe"
 )
 
 // A ByteView holds an immutable view of bytes.
@@ -13,11 +16,41 @@ import (
 //
 // A ByteView is meant to be used as a value type, not
 // a pointer (like a time.Time).
+//
+// The bytes of a ByteView are never modified, so it is safe to share
+// between goroutines. Methods returning a []byte return a copy that
+// the caller may modify. Slice and SliceFrom alias the underlying
+// bytes without copying; a string result shares them only if the view
+// wraps a string, and is a copy otherwise.
+//
+// A ByteView handed out by a Store, by Peek, a Sink or otherwise, stays
+// valid and unchanged for as long as the caller holds it, even after
+// its entry is evicted or replaced: heap values are only freed by the
+// garbage collector, and values held off the heap are copied before
+// they are handed out.
 type ByteView struct {
 	b []byte
 	s string
 }
 
+// NewByteView returns a ByteView holding a copy of b.
+func NewByteView(b []byte) ByteView {
+	return ByteView{b: cloneBytes(b)}
+}
+
+// NewStringView returns a ByteView holding s.
+func NewStringView(s string) ByteView {
+	if s == "" {
+		return ByteView{b: emptyBytes}
+	}
+	return ByteView{s: s}
+}
+
+// emptyBytes backs views of an empty value, so that they are told
+// apart from the zero ByteView by their non-nil b. Having no capacity,
+// it is never written to.
+var emptyBytes = []byte{}
+
 // Len returns the view's length.
 func (v ByteView) Len() int {
 	if v.b != nil {
@@ -26,6 +59,22 @@ func (v ByteView) Len() int {
 	return len(v.s)
 }
 
+// IsEmpty reports whether the view holds no bytes, either because it
+// holds an empty value or because it is the zero ByteView.
+func (v ByteView) IsEmpty() bool {
+	return v.Len() == 0
+}
+
+// IsZero reports whether v is the zero ByteView, which holds no value
+// at all, as opposed to a view of an empty value, such as an empty
+// value cached deliberately for a key known to be missing. Views made
+// by NewByteView, NewStringView and Sinks, and those handed out by a
+// Store, are never zero, even when empty; slicing a view keeps it
+// non-zero.
+func (v ByteView) IsZero() bool {
+	return v.b == nil && v.s == ""
+}
+
 // ByteSlice returns a copy of the data as a byte slice.
 func (v ByteView) ByteSlice() []byte {
 	if v.b != nil {
@@ -34,7 +83,8 @@ func (v ByteView) ByteSlice() []byte {
 	return []byte(v.s)
 }
 
-// String returns the data as a string, making a copy if necessary.
+// String returns the data as a string, making a copy if the view
+// wraps a []byte.
 func (v ByteView) String() string {
 	if v.b != nil {
 		return string(v.b)
@@ -55,7 +105,7 @@ func (v ByteView) Slice(from, to int) ByteView {
 	if v.b != nil {
 		return ByteView{b: v.b[from:to]}
 	}
-	return ByteView{s: v.s[from:to]}
+	return NewStringView(v.s[from:to])
 }
 
 // SliceFrom slices the view from the provided index until the end.
@@ -63,7 +113,7 @@ func (v ByteView) SliceFrom(from int) ByteView {
 	if v.b != nil {
 		return ByteView{b: v.b[from:]}
 	}
-	return ByteView{s: v.s[from:]}
+	return NewStringView(v.s[from:])
 }
 
 // Copy copies b into dest and returns the number of bytes copied.
@@ -74,6 +124,27 @@ func (v ByteView) Copy(dest []byte) int {
 	return copy(dest, v.s)
 }
 
+// Append returns a view of the bytes of v followed by those of other,
+// copied into a new buffer.
+func (v ByteView) Append(other ByteView) ByteView {
+	return ConcatViews(v, other)
+}
+
+// ConcatViews returns a view of the bytes of views joined in order,
+// copied into a single new buffer.
+func ConcatViews(views ...ByteView) ByteView {
+	n := 0
+	for _, v := range views {
+		n += v.Len()
+	}
+	b := make([]byte, n)
+	off := 0
+	for _, v := range views {
+		off += v.Copy(b[off:])
+	}
+	return ByteView{b: b}
+}
+
 // Equal returns whether the bytes in b are the same as the bytes in
 // b2.
 func (v ByteView) Equal(b2 ByteView) bool {
@@ -119,6 +190,15 @@ func (v ByteView) EqualBytes(b2 []byte) bool {
 	return true
 }
 
+// unsafeBytes returns the data as a byte slice without copying. The
+// returned slice aliases the view's memory and must not be modified.
+func (v ByteView) unsafeBytes() []byte {
+	if v.b != nil {
+		return v.b
+	}
+	return unsafe.Slice(unsafe.StringData(v.s), len(v.s))
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
@@ -148,17 +228,45 @@ func (v ByteView) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
-// WriteTo implements io.WriterTo on the bytes in v.
+// WriteTo implements io.WriterTo on the bytes in v. The bytes are
+// passed to w without copying.
 func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
-	var m int
-	if v.b != nil {
-		m, err = w.Write(v.b)
-	} else {
-		m, err = io.WriteString(w, v.s)
-	}
+	m, err := w.Write(v.unsafeBytes())
 	if err == nil && m < v.Len() {
 		err = io.ErrShortWrite
 	}
 	n = int64(m)
 	return
 }
+
+// MarshalJSON implements json.Marshaler, encoding the bytes in v as a
+// base64 string, as encoding/json does for a []byte. Views of a string
+// are encoded the same way, so that UnmarshalJSON restores any view.
+// The zero ByteView is encoded as null.
+func (v ByteView) MarshalJSON() ([]byte, error) {
+	if v.IsZero() {
+		return []byte("null"), nil
+	}
+	b := v.unsafeBytes()
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(b))+2)
+	out[0] = '"'
+	base64.StdEncoding.Encode(out[1:], b)
+	out[len(out)-1] = '"'
+	return out, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding a base64 string
+// as made by MarshalJSON into v. The JSON null makes v the zero
+// ByteView.
+func (v *ByteView) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = ByteView{}
+		return nil
+	}
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	*v = ByteView{b: b}
+	return nil
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConcatViews(t *testing.T) {
+	header := NewStringView("header:")
+	body := NewByteView([]byte("body"))
+	if got := header.Append(body); !got.EqualString("header:body") {
+		t.Errorf("Append = %q; want %q", got, "header:body")
+	}
+	if got := ConcatViews(body, header, body); !got.EqualString("bodyheader:body") {
+		t.Errorf("ConcatViews = %q; want %q", got, "bodyheader:body")
+	}
+	if got := ConcatViews(); got.Len() != 0 {
+		t.Errorf("ConcatViews() = %q; want empty", got)
+	}
+}
+
+func TestByteViewJSON(t *testing.T) {
+	type response struct {
+		Key   string
+		Value ByteView
+	}
+	for _, v := range []ByteView{NewStringView("hello"), NewByteView([]byte{0, 1, 0xff}), NewStringView(""), {}} {
+		b, err := json.Marshal(response{Key: "k", Value: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got response
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", b, err)
+		}
+		if !got.Value.Equal(v) || got.Value.IsZero() != v.IsZero() {
+			t.Errorf("round trip of %q through %s = %q", v, b, got.Value)
+		}
+	}
+	if b, _ := json.Marshal(NewStringView("hi")); string(b) != `"aGk="` {
+		t.Errorf("Marshal = %s; want %s", b, `"aGk="`)
+	}
+	var v ByteView
+	if err := json.Unmarshal([]byte(`"not base64!"`), &v); err == nil {
+		t.Error("Unmarshal accepted invalid base64")
+	}
+}
+
+func TestByteViewIsZero(t *testing.T) {
+	var bv ByteView
+	set := []ByteView{
+		NewStringView(""),
+		NewByteView(nil),
+		NewStringView("abc").Slice(1, 1),
+		NewStringView("abc").SliceFrom(3),
+		sinkView(t, StringSink(new(string))),
+		sinkView(t, ByteViewSink(&bv)),
+		sinkView(t, AllocatingByteSliceSink(new([]byte))),
+	}
+	for i, v := range set {
+		if !v.IsEmpty() || v.IsZero() {
+			t.Errorf("view %d: IsEmpty = %v, IsZero = %v; want true, false", i, v.IsEmpty(), v.IsZero())
+		}
+	}
+	if v := (ByteView{}); !v.IsEmpty() || !v.IsZero() {
+		t.Errorf("zero view: IsEmpty = %v, IsZero = %v; want true, true", v.IsEmpty(), v.IsZero())
+	}
+	if v := NewStringView("a"); v.IsEmpty() || v.IsZero() {
+		t.Errorf("view of %q: IsEmpty = %v, IsZero = %v", "a", v.IsEmpty(), v.IsZero())
+	}
+}
+
+// sinkView returns the view held by s after setting it to "".
+func sinkView(t *testing.T, s Sink) ByteView {
+	t.Helper()
+	if err := s.SetString(""); err != nil {
+		t.Fatal(err)
+	}
+	bv, err := s.view()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bv
+}
@@ -2,21 +2,200 @@ package cache
 
 import (
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/FeiniuBus/cache/clock"
+	"github.com/FeiniuBus/cache/lfu"
 	"github.com/FeiniuBus/cache/lru"
 )
 
-// cache is a wrapper around an *lru.Cache that adds synchronization,
+// An EvictionPolicy chooses which entry a cache evicts when it is full.
+type EvictionPolicy int
+
+const (
+	// PolicyLRU evicts the least recently used entry.
+	PolicyLRU EvictionPolicy = iota
+
+	// PolicyClock approximates LRU with the CLOCK (second-chance)
+	// algorithm. Cache hits only set a reference bit, so reads take a
+	// shared lock and don't contend with each other.
+	PolicyClock
+
+	// PolicyLFU evicts the least frequently used entry, breaking ties
+	// by recency. The most recently added entry is spared until
+	// another is added, so that a new key hit again in the meantime
+	// can displace entries with higher counts. With WithDecayInterval,
+	// access counts are halved periodically so that entries that are
+	// no longer hot age out.
+	PolicyLFU
+)
+
+// An EvictReason tells why an entry left a store's cache.
+type EvictReason int
+
+const (
+	// EvictCapacity is the reason for entries evicted to make room.
+	EvictCapacity EvictReason = iota
+
+	// EvictRemoved is the reason for entries removed by Remove,
+	// RemoveAll or RemovePrefix, or dropped when a new value for
+	// their key was not admitted.
+	EvictRemoved
+
+	// EvictExpired is the reason for entries that had expired, or
+	// been made stale by Invalidate, when they were evicted.
+	EvictExpired
+
+	// EvictFlushed is the reason for entries removed by Flush.
+	EvictFlushed
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictRemoved:
+		return "removed"
+	case EvictExpired:
+		return "expired"
+	case EvictFlushed:
+		return "flushed"
+	}
+	return "EvictReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// An eviction records an entry that left the cache. value is only set
+// if the cache keeps evicted values.
+type eviction struct {
+	key    string
+	value  ByteView
+	reason EvictReason
+}
+
+// A Backend is the ordered key-value structure that holds a store's
+// entries, such as *lru.Cache and *clock.Cache. The store serializes
+// calls to it, keeps the byte accounting and stats, and treats the
+// values as opaque. RemoveOldest must remove the entry the backend's
+// eviction policy chooses.
+type Backend interface {
+	Add(key string, value interface{})
+	Get(key string) (value interface{}, ok bool)
+	Peek(key string) (value interface{}, ok bool)
+	Remove(key string) bool
+	RemoveOldest() (key string, value interface{}, ok bool)
+	Each(fn func(key string, value interface{}) bool)
+	Len() int
+	Clear()
+}
+
+var (
+	_ Backend = (*lru.Cache)(nil)
+	_ Backend = (*clock.Cache)(nil)
+	_ Backend = (*lfu.Cache)(nil)
+)
+
+// cache is a wrapper around a Backend that adds synchronization,
 // makes values always be ByteView, and counts the size of all keys and
 // values.
 type cache struct {
-	mu         sync.RWMutex
-	nbytes     int64
-	lru        *lru.Cache
+	// nhit and nget are updated atomically, as gets may only hold a
+	// read lock. They are first so that they are 8-byte aligned on
+	// 32-bit platforms.
 	nhit, nget int64
-	nevict     int64
+
+	mu sync.RWMutex
+
+	// nbytes is the total cost of all keys and values. Unless cost is
+	// set, the cost of an entry is its key and value length in bytes.
+	// overhead is added to the cost of each entry.
+	nbytes   int64
+	cost     func(key string, value ByteView) int64
+	overhead int64
+	offHeap  bool
+	arena    offHeapArena
+	policy   EvictionPolicy
+	decay    time.Duration
+	sliding  time.Duration
+	ev       Backend
+
+	// pinned holds the entries moved out of ev by pin, which are never
+	// evicted. Their cost, npinned, counts toward nbytes and is capped
+	// at maxPinned.
+	pinned    map[string]*entry
+	npinned   int64
+	maxPinned int64
+
+	// evictions records the entries that leave the cache, with the
+	// reason set by the operation removing them, until the operation
+	// takes them to return. keepEvicted is whether their values are
+	// recorded as well.
+	evictions   []eviction
+	reason      EvictReason
+	keepEvicted bool
+
+	// newBackend, if set, creates ev in place of the policy's.
+	newBackend func(onEvicted func(key string, value interface{})) Backend
+
+	// gen points to the store's generation, which is read
+	// atomically. Entries added in an earlier generation are stale
+	// and treated as absent.
+	gen *int64
+
+	nevict int64
+
+	// noffHeapFallback counts the values kept on the heap because the
+	// arena could not map memory for them.
+	noffHeapFallback int64
+
+	// nvalbytes is the total length of the cached values alone.
+	// minval and maxval are the smallest and largest value lengths
+	// ever added; they are not lowered or raised by eviction.
+	nvalbytes      int64
+	minval, maxval int64
+	nadded         int64
+}
+
+// An entry is a cached value along with its bookkeeping.
+type entry struct {
+	// lastAccess, in Unix nanoseconds, and hits are updated
+	// atomically, as is expires, the Unix nanosecond time after which
+	// the entry is stale, or 0 if it never expires. They are first so
+	// that they are 8-byte aligned on 32-bit platforms.
+	lastAccess int64
+	hits       int64
+	expires    int64
+
+	value    ByteView
+	loadedAt time.Time
+	gen      int64
+
+	// offHeap is whether value's bytes live in memory allocated by
+	// the shard's arena, to be freed when the entry leaves the cache.
+	offHeap bool
+
+	// meta is metadata stored with the value by SetWithMeta. It is
+	// never modified.
+	meta map[string]string
+
+	// pinned is whether the entry is held in the cache's pinned map
+	// rather than its backend.
+	pinned bool
+
+	// sliding is whether every hit on the entry pushes back its
+	// expiry, as set by WithSlidingTTL.
+	sliding bool
+}
+
+// view returns the entry's value for use outside the cache. Off-heap
+// values are copied so that the returned view outlives the entry.
+func (e *entry) view() ByteView {
+	if e.offHeap {
+		return ByteView{b: cloneBytes(e.value.b)}
+	}
+	return e.value
 }
 
 func (c *cache) stats() CacheStats {
@@ -24,58 +203,598 @@ func (c *cache) stats() CacheStats {
 	defer c.mu.RUnlock()
 	return CacheStats{
 		Bytes:     c.nbytes,
-		Gets:      c.nget,
-		Hits:      c.nhit,
+		Gets:      atomic.LoadInt64(&c.nget),
+		Hits:      atomic.LoadInt64(&c.nhit),
 		Evictions: c.nevict,
 		Items:     c.itemsLocked(),
+
+		OffHeapFallbacks: c.noffHeapFallback,
+	}
+}
+
+func (c *cache) expired() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.expiredLocked()
+}
+
+// expiredLocked counts the entries that are stale or expired but not
+// yet removed.
+func (c *cache) expiredLocked() int64 {
+	if c.ev == nil {
+		return 0
+	}
+	var n int64
+	c.ev.Each(func(_ string, value interface{}) bool {
+		if c.stale(value.(*entry)) {
+			n++
+		}
+		return true
+	})
+	for _, e := range c.pinned {
+		if c.stale(e) {
+			n++
+		}
 	}
+	return n
 }
 
-func (c *cache) add(key string, value ByteView) {
+func (c *cache) resetStats() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = &lru.Cache{
-			OnEvicted: func(key string, value interface{}) {
-				val := value.(ByteView)
-				c.nbytes -= int64(len(key)) + int64(val.Len())
-				c.nevict++
-			},
+	atomic.StoreInt64(&c.nget, 0)
+	atomic.StoreInt64(&c.nhit, 0)
+	c.nevict = 0
+}
+
+func (c *cache) newEvictor() Backend {
+	onEvicted := func(key string, value interface{}) {
+		e := value.(*entry)
+		if e.pinned {
+			// pin is moving it to the pinned map.
+			return
 		}
+		c.recordLocked(key, e, c.reason)
+		c.release(key, e)
+		c.nevict++
+	}
+	if c.newBackend != nil {
+		return c.newBackend(onEvicted)
 	}
-	c.lru.Add(key, value)
-	c.nbytes += int64(len(key)) + int64(value.Len())
+	switch c.policy {
+	case PolicyClock:
+		return &clock.Cache{OnEvicted: onEvicted}
+	case PolicyLFU:
+		return &lfu.Cache{OnEvicted: onEvicted, DecayInterval: c.decay}
+	}
+	return &lru.Cache{OnEvicted: onEvicted}
 }
 
-func (c *cache) get(key string) (value ByteView, ok bool) {
+// recordLocked records that e is leaving the cache for reason. Entries
+// evicted for room that were already stale are recorded as expired.
+func (c *cache) recordLocked(key string, e *entry, reason EvictReason) {
+	if reason == EvictCapacity && c.stale(e) {
+		reason = EvictExpired
+	}
+	ev := eviction{key: key, reason: reason}
+	if c.keepEvicted {
+		ev.value = e.view()
+	}
+	c.evictions = append(c.evictions, ev)
+}
+
+// takeEvictionsLocked returns and forgets the recorded evictions.
+func (c *cache) takeEvictionsLocked() []eviction {
+	evs := c.evictions
+	c.evictions = nil
+	return evs
+}
+
+// removeFromBackendLocked removes key from the backend, recording its
+// entry as leaving for reason.
+func (c *cache) removeFromBackendLocked(key string, reason EvictReason) {
+	c.reason = reason
+	c.ev.Remove(key)
+	c.reason = EvictCapacity
+}
+
+// stale reports whether e was added before the current generation or
+// has expired.
+func (c *cache) stale(e *entry) bool {
+	if c.gen != nil && e.gen < atomic.LoadInt64(c.gen) {
+		return true
+	}
+	exp := atomic.LoadInt64(&e.expires)
+	return exp != 0 && time.Now().UnixNano() >= exp
+}
+
+// touch makes the live entry for key expire ttl from now, or never if
+// ttl <= 0, without updating its recency. The expiry is explicit and no
+// longer slides with hits. It reports whether there was such an entry.
+// It takes the write lock, as hits read e.sliding under the read lock.
+func (c *cache) touch(key string, ttl time.Duration) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.nget++
-	if c.lru == nil {
-		return
+	e, ok := c.peekLocked(key)
+	if !ok || c.stale(e) {
+		return false
+	}
+	var exp int64
+	if ttl > 0 {
+		exp = time.Now().Add(ttl).UnixNano()
+	}
+	atomic.StoreInt64(&e.expires, exp)
+	e.sliding = false
+	return true
+}
+
+// add adds value under key, then evicts entries until the cache's cost
+// is at most limit, returning the evicted keys. gen is the generation
+// the value was loaded in, and expires the Unix nanosecond time at
+// which it expires, or 0. Adding and evicting under one lock keeps
+// concurrent adds from pushing the cache over limit between the two.
+func (c *cache) add(key string, value ByteView, meta map[string]string, expires, gen, limit int64) (evicted []eviction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(key, value, meta, expires, gen)
+	return c.evictToFitLocked(limit)
+}
+
+// getOrAdd returns the live value cached under key, or else adds value
+// under key, evicting as add does, and returns it. loaded reports
+// whether the value was already cached.
+func (c *cache) getOrAdd(key string, value ByteView, gen, limit int64) (actual ByteView, loaded bool, evicted []eviction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.AddInt64(&c.nget, 1)
+	if e, ok := c.getLocked(key); ok && !c.stale(e) {
+		atomic.AddInt64(&c.nhit, 1)
+		c.hitLocked(e)
+		return e.view(), true, nil
+	}
+	c.addLocked(key, value, nil, 0, gen)
+	return value, false, c.evictToFitLocked(limit)
+}
+
+func (c *cache) addLocked(key string, value ByteView, meta map[string]string, expires, gen int64) {
+	if c.ev == nil {
+		c.ev = c.newEvictor()
+	}
+	// A value replacing a pinned one stays pinned.
+	old, wasPinned := c.pinned[key]
+	if wasPinned {
+		c.dropPinnedLocked(key, old)
+	} else if vi, ok := c.ev.Peek(key); ok {
+		c.release(key, vi.(*entry))
+	}
+	now := time.Now()
+	e := &entry{value: value, loadedAt: now, gen: gen, lastAccess: now.UnixNano(), expires: expires, meta: meta}
+	if expires == 0 && c.sliding > 0 {
+		e.expires = now.Add(c.sliding).UnixNano()
+		e.sliding = true
+	}
+	if c.offHeap && value.Len() > 0 {
+		if b, err := c.arena.alloc(value.Len()); err == nil {
+			value.Copy(b)
+			e.value = ByteView{b: b}
+			e.offHeap = true
+		} else {
+			c.noffHeapFallback++
+		}
+	}
+	cost := c.entryCost(key, e)
+	if wasPinned && c.npinned+cost <= c.maxPinned {
+		c.pinLocked(key, e, cost)
+	} else {
+		c.ev.Add(key, e)
 	}
-	vi, ok := c.lru.Get(key)
+	c.nbytes += cost
+
+	n := int64(value.Len())
+	c.nvalbytes += n
+	if c.nadded == 0 || n < c.minval {
+		c.minval = n
+	}
+	if n > c.maxval {
+		c.maxval = n
+	}
+	c.nadded++
+}
+
+// release undoes the accounting for e, which is leaving the cache,
+// and frees its off-heap memory.
+func (c *cache) release(key string, e *entry) {
+	c.nbytes -= c.entryCost(key, e)
+	c.nvalbytes -= int64(e.value.Len())
+	if e.offHeap {
+		c.arena.free(e.value.b)
+	}
+}
+
+// metaCost is the cost of an entry's metadata: the length of its keys
+// and values.
+func metaCost(meta map[string]string) int64 {
+	var n int64
+	for k, v := range meta {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for k, v := range meta {
+		c[k] = v
+	}
+	return c
+}
+
+// entryCost is the cost of e cached under key, including its metadata.
+func (c *cache) entryCost(key string, e *entry) int64 {
+	cost := c.costOf(key, e.value) + metaCost(e.meta)
+	if e.offHeap {
+		// Charge the memory the value's slot or mapping takes.
+		cost += int64(cap(e.value.b) - e.value.Len())
+	}
+	return cost
+}
+
+func (c *cache) costOf(key string, value ByteView) int64 {
+	if c.cost != nil {
+		return c.cost(key, value) + c.overhead
+	}
+	return int64(len(key)) + int64(value.Len()) + c.overhead
+}
+
+// get returns the live value for key. If maxAge is positive, a value
+// loaded longer ago is treated as absent.
+func (c *cache) get(key string, maxAge time.Duration) (value ByteView, meta map[string]string, ok bool) {
+	// An LRU moves the entry on every hit, so it needs the write
+	// lock; CLOCK only sets a bit atomically. A custom backend may
+	// change on Get, too.
+	if c.policy == PolicyClock && c.newBackend == nil {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+	} else {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	atomic.AddInt64(&c.nget, 1)
+	e, ok := c.getLocked(key)
 	if !ok {
 		return
 	}
-	c.nhit++
-	return vi.(ByteView), true
+	if c.stale(e) || maxAge > 0 && time.Since(e.loadedAt) > maxAge {
+		return ByteView{}, nil, false
+	}
+	atomic.AddInt64(&c.nhit, 1)
+	c.hitLocked(e)
+	return e.view(), e.meta, true
+}
+
+func (c *cache) peek(key string) (value ByteView, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.peekLocked(key)
+	if !ok || c.stale(e) {
+		return ByteView{}, false
+	}
+	return e.view(), true
 }
 
-func (c *cache) remove(key string) {
+// hitLocked records a hit on e, pushing back its expiry if it slides.
+// It only writes e atomically, so a read lock is enough.
+func (c *cache) hitLocked(e *entry) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&e.lastAccess, now)
+	atomic.AddInt64(&e.hits, 1)
+	if e.sliding {
+		// Don't write the expiry on every hit of a hot entry; a
+		// hundredth of the TTL is close enough.
+		exp := now + int64(c.sliding)
+		if exp-atomic.LoadInt64(&e.expires) > int64(c.sliding/100) {
+			atomic.StoreInt64(&e.expires, exp)
+		}
+	}
+}
+
+// getLocked returns the entry for key, pinned or not, recording the
+// access with the backend.
+func (c *cache) getLocked(key string) (*entry, bool) {
+	if e, ok := c.pinned[key]; ok {
+		return e, true
+	}
+	if c.ev == nil {
+		return nil, false
+	}
+	vi, ok := c.ev.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return vi.(*entry), true
+}
+
+// peekLocked is like getLocked, without recording the access.
+func (c *cache) peekLocked(key string) (*entry, bool) {
+	if e, ok := c.pinned[key]; ok {
+		return e, true
+	}
+	if c.ev == nil {
+		return nil, false
+	}
+	vi, ok := c.ev.Peek(key)
+	if !ok {
+		return nil, false
+	}
+	return vi.(*entry), true
+}
+
+func (c *cache) info(key string) (info EntryInfo, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.peekLocked(key)
+	if !ok || c.stale(e) {
+		return EntryInfo{}, false
+	}
+	info = EntryInfo{
+		LoadedAt:   e.loadedAt,
+		LastAccess: time.Unix(0, atomic.LoadInt64(&e.lastAccess)),
+		Hits:       atomic.LoadInt64(&e.hits),
+		Bytes:      int64(e.value.Len()),
+	}
+	if exp := atomic.LoadInt64(&e.expires); exp != 0 {
+		info.Expires = time.Unix(0, exp)
+	}
+	return info, true
+}
+
+// remove removes the entry for key and returns it as evicted, if there
+// was one.
+func (c *cache) remove(key string) []eviction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key, EvictRemoved)
+	return c.takeEvictionsLocked()
+}
+
+// removeLocked removes the entry for key, pinned or not, for reason.
+func (c *cache) removeLocked(key string, reason EvictReason) {
+	if e, ok := c.pinned[key]; ok {
+		c.evictPinnedLocked(key, e, reason)
+	} else if c.ev != nil {
+		c.removeFromBackendLocked(key, reason)
+	}
+}
+
+// pin moves the live entry for key out of the backend, so that it is
+// never evicted, unless that would make the pinned entries cost more
+// than maxPinned. It reports whether the entry is pinned.
+func (c *cache) pin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinned[key]; ok {
+		return true
+	}
+	if c.ev == nil {
+		return false
+	}
+	vi, ok := c.ev.Peek(key)
+	if !ok || c.stale(vi.(*entry)) {
+		return false
+	}
+	e := vi.(*entry)
+	cost := c.entryCost(key, e)
+	if c.npinned+cost > c.maxPinned {
+		return false
+	}
+	c.pinLocked(key, e, cost)
+	// The entry is marked pinned, so the backend's onEvicted leaves
+	// its accounting alone.
+	c.ev.Remove(key)
+	return true
+}
+
+func (c *cache) pinLocked(key string, e *entry, cost int64) {
+	if c.pinned == nil {
+		c.pinned = make(map[string]*entry)
+	}
+	e.pinned = true
+	c.pinned[key] = e
+	c.npinned += cost
+}
+
+// unpin moves the pinned entry for key back to the backend, as its
+// most recently used entry. It reports whether the entry was pinned.
+func (c *cache) unpin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.pinned[key]
+	if !ok {
+		return false
+	}
+	delete(c.pinned, key)
+	c.npinned -= c.entryCost(key, e)
+	e.pinned = false
+	c.ev.Add(key, e)
+	return true
+}
+
+// evictPinnedLocked removes the pinned entry e for key from the cache
+// for reason.
+func (c *cache) evictPinnedLocked(key string, e *entry, reason EvictReason) {
+	c.recordLocked(key, e, reason)
+	c.dropPinnedLocked(key, e)
+	c.nevict++
+}
+
+// dropPinnedLocked removes the pinned entry e for key from the cache.
+func (c *cache) dropPinnedLocked(key string, e *entry) {
+	delete(c.pinned, key)
+	c.npinned -= c.entryCost(key, e)
+	e.pinned = false
+	c.release(key, e)
+}
+
+// keys returns the live keys starting with prefix.
+func (c *cache) keys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.ev == nil {
+		return nil
+	}
+	var keys []string
+	c.ev.Each(func(key string, value interface{}) bool {
+		if strings.HasPrefix(key, prefix) && !c.stale(value.(*entry)) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for key, e := range c.pinned {
+		if strings.HasPrefix(key, prefix) && !c.stale(e) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// savedEntry is what each passes on of a cached entry.
+type savedEntry struct {
+	value ByteView
+	meta  map[string]string
+
+	// expires is the entry's expiry in Unix nanoseconds, or 0.
+	expires int64
+}
+
+// each calls fn for each live entry, from least to most recently used,
+// then for the pinned entries. The entries are collected under the lock
+// and fn is called after it is released, so fn may be slow.
+func (c *cache) each(fn func(key string, e savedEntry) error) error {
+	c.mu.RLock()
+	var keys []string
+	var values []savedEntry
+	save := func(key string, e *entry) {
+		if !c.stale(e) {
+			keys = append(keys, key)
+			values = append(values, savedEntry{e.view(), e.meta, atomic.LoadInt64(&e.expires)})
+		}
+	}
+	for key, e := range c.pinned {
+		save(key, e)
+	}
+	if c.ev != nil {
+		c.ev.Each(func(key string, vi interface{}) bool {
+			save(key, vi.(*entry))
+			return true
+		})
+	}
+	c.mu.RUnlock()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePrefix removes all keys starting with prefix and returns their
+// entries as evicted.
+func (c *cache) removePrefix(prefix string) []eviction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ev == nil {
+		return nil
+	}
+	var keys []string
+	c.ev.Each(func(key string, _ interface{}) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for key := range c.pinned {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		c.removeLocked(key, EvictRemoved)
+	}
+	return c.takeEvictionsLocked()
+}
+
+// clear removes all entries and returns them as evicted.
+func (c *cache) clear() []eviction {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru != nil {
-		c.lru.Remove(key)
+	if c.ev == nil {
+		return nil
+	}
+	c.reason = EvictFlushed
+	c.ev.Clear()
+	c.reason = EvictCapacity
+	for key, e := range c.pinned {
+		c.evictPinnedLocked(key, e, EvictFlushed)
 	}
+	return c.takeEvictionsLocked()
 }
 
-func (c *cache) removeOldest() {
+// removeKeys removes the entries for keys and returns them as evicted.
+func (c *cache) removeKeys(keys []string) []eviction {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru != nil {
-		c.lru.RemoveOldest()
+	if c.ev == nil {
+		return nil
+	}
+	for _, key := range keys {
+		c.removeLocked(key, EvictRemoved)
+	}
+	return c.takeEvictionsLocked()
+}
+
+// oldest returns the key the backend would evict next, if it can tell
+// without evicting it and that entry is live.
+func (c *cache) oldest() (key string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	o, isOldester := c.ev.(interface {
+		Oldest() (key string, value interface{}, ok bool)
+	})
+	if !isOldester {
+		return "", false
+	}
+	key, vi, ok := o.Oldest()
+	if !ok || c.stale(vi.(*entry)) {
+		return "", false
+	}
+	return key, true
+}
+
+// evictToFitLocked evicts entries until the cache's cost is at most
+// limit and returns them, with any other entries that left the cache in
+// the current operation.
+func (c *cache) evictToFitLocked(limit int64) []eviction {
+	if c.ev == nil {
+		return c.takeEvictionsLocked()
 	}
+	if c.nbytes > limit {
+		// Stale pinned entries are never served again; don't let them
+		// hold on to their share of the budget.
+		for key, e := range c.pinned {
+			if c.stale(e) {
+				c.evictPinnedLocked(key, e, EvictExpired)
+			}
+		}
+	}
+	for c.nbytes > limit {
+		if _, _, ok := c.ev.RemoveOldest(); !ok {
+			break
+		}
+	}
+	return c.takeEvictionsLocked()
 }
 
 func (c *cache) bytes() int64 {
@@ -91,13 +810,14 @@ func (c *cache) items() int64 {
 }
 
 func (c *cache) itemsLocked() int64 {
-	if c.lru == nil {
+	if c.ev == nil {
 		return 0
 	}
-	return int64(c.lru.Len())
+	return int64(c.ev.Len() + len(c.pinned))
 }
 
-// An AtomicInt is an int64 to be accessed atomically.
+// An AtomicInt is an int64 to be accessed atomically. An AtomicInt
+// must not be copied while it may be in use; read it with Get instead.
 type AtomicInt int64
 
 // Add atomically adds n to i.
@@ -110,15 +830,72 @@ func (i *AtomicInt) Get() int64 {
 	return atomic.LoadInt64((*int64)(i))
 }
 
+// Store atomically sets the value of i to n.
+func (i *AtomicInt) Store(n int64) {
+	atomic.StoreInt64((*int64)(i), n)
+}
+
+// CompareAndSwap atomically sets the value of i to new if it is
+// currently old, and reports whether it did.
+func (i *AtomicInt) CompareAndSwap(old, new int64) bool {
+	return atomic.CompareAndSwapInt64((*int64)(i), old, new)
+}
+
 func (i *AtomicInt) String() string {
 	return strconv.FormatInt(i.Get(), 10)
 }
 
-// CacheStats are returned by stats accessors on Group.
+// CacheStats are returned by stats accessors on Store.
 type CacheStats struct {
-	Bytes     int64
-	Items     int64
+	Bytes int64
+	Items int64
+
 	Gets      int64
 	Hits      int64
 	Evictions int64
+
+	// OffHeapFallbacks is the number of values that a store created
+	// WithOffHeapStorage kept on the Go heap because off-heap memory
+	// could not be mapped.
+	OffHeapFallbacks int64
+}
+
+// SizeStats describe the distribution of cached value lengths.
+type SizeStats struct {
+	// MinValueBytes and MaxValueBytes are the smallest and largest
+	// value lengths added to the cache since it was created.
+	MinValueBytes int64
+	MaxValueBytes int64
+
+	// AvgValueBytes is the average length of the values currently
+	// in the cache.
+	AvgValueBytes int64
+}
+
+// EntryInfo describes a cached entry.
+type EntryInfo struct {
+	// LoadedAt is when the value was added to the cache.
+	LoadedAt time.Time
+
+	// LastAccess is when the value was last served from the cache,
+	// or LoadedAt if it has not been served yet.
+	LastAccess time.Time
+
+	// Hits is the number of times the value was served from the
+	// cache.
+	Hits int64
+
+	// Bytes is the length of the value.
+	Bytes int64
+
+	// Expires is when the value expires, or the zero Time if it
+	// doesn't.
+	Expires time.Time
 }
+
+// noCopy may be embedded into structs which must not be copied after
+// first use, so that go vet's copylocks checker reports copies.
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
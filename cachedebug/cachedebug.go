@@ -0,0 +1,81 @@
+// Package cachedebug provides an http.Handler that exposes the
+// registered stores for introspection.
+package cachedebug
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/FeiniuBus/cache"
+)
+
+type storeInfo struct {
+	Name       string           `json:"name"`
+	Stats      map[string]int64 `json:"stats"`
+	CacheStats cache.CacheStats `json:"cacheStats"`
+}
+
+type peekResult struct {
+	Store string         `json:"store"`
+	Key   string         `json:"key"`
+	Found bool           `json:"found"`
+	Value cache.ByteView `json:"value"`
+}
+
+// Handler returns an http.Handler that serves a JSON listing of all
+// registered stores with their stats. When both the store and key
+// query parameters are given, it instead peeks the cached value of
+// key in the named store without loading it; the value is encoded
+// in base64, as by ByteView.MarshalJSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if name, key := q.Get("store"), q.Get("key"); name != "" && key != "" {
+		s := cache.GetStore(name)
+		if s == nil {
+			http.Error(w, "no such store: "+name, http.StatusNotFound)
+			return
+		}
+		v, ok := s.Peek(key)
+		writeJSON(w, peekResult{
+			Store: name,
+			Key:   key,
+			Found: ok,
+			Value: v,
+		})
+		return
+	}
+
+	stores := cache.Stores()
+	infos := make([]storeInfo, 0, len(stores))
+	for _, s := range stores {
+		st := s.Snapshot()
+		infos = append(infos, storeInfo{
+			Name: s.Name(),
+			Stats: map[string]int64{
+				"gets":          st.Gets,
+				"cacheHits":     st.CacheHits,
+				"loads":         st.Loads,
+				"loadsDeduped":  st.LoadsDeduped,
+				"localLoadErrs": st.LocalLoadErrs,
+				"localLoads":    st.LocalLoads,
+				"secondaryHits": st.SecondaryHits,
+				"secondaryErrs": st.SecondaryErrs,
+				"staleGets":     st.StaleGets,
+				"loadsSwept":    st.LoadsSwept,
+			},
+			CacheStats: s.CacheStats(),
+		})
+	}
+	writeJSON(w, infos)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
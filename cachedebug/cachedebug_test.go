@@ -0,0 +1,67 @@
+package cachedebug
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FeiniuBus/cache"
+)
+
+func init() {
+	cache.NewStore("debug-store", 1<<20, cache.GetterFunc(func(key string, dest cache.Sink) error {
+		return dest.SetString("ECHO: " + key)
+	}))
+}
+
+func TestHandlerListsStores(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/cache", nil))
+
+	var infos []storeInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "debug-store" {
+		t.Fatalf("got %+v; want a single debug-store entry", infos)
+	}
+}
+
+func TestHandlerPeek(t *testing.T) {
+	var s string
+	store := cache.GetStore("debug-store")
+	if err := store.Get("foo", cache.StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("bin", cache.NewByteView([]byte{0xff, 0, 0xfe}))
+
+	tests := []struct {
+		key   string
+		found bool
+		value string
+	}{
+		{"foo", true, "ECHO: foo"},
+		{"bin", true, "\xff\x00\xfe"},
+		{"bar", false, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/cache?store=debug-store&key="+tt.key, nil))
+
+		var res peekResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Found != tt.found || res.Value.String() != tt.value {
+			t.Errorf("peek %q = %+v; want found=%v value=%q", tt.key, res, tt.found, tt.value)
+		}
+	}
+}
+
+func TestHandlerUnknownStore(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/cache?store=nope&key=k", nil))
+	if rec.Code != 404 {
+		t.Errorf("status = %d; want 404", rec.Code)
+	}
+}
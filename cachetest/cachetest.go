@@ -0,0 +1,77 @@
+// Package cachetest provides helpers for testing code that uses cache
+// stores.
+package cachetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/FeiniuBus/cache"
+)
+
+// ErrNotFound is returned by the getter of a store made by NewMapStore
+// for keys missing from its data.
+var ErrNotFound = errors.New("cachetest: key not found")
+
+// DefaultCacheBytes is the cache size of stores made by NewMapStore.
+const DefaultCacheBytes = 1 << 20
+
+// NewMapStore returns a store whose getter loads values from a copy of
+// data, failing with ErrNotFound for other keys. The store is
+// registered under name as by cache.NewStore, which panics if the name
+// is taken; if name is empty, the store is not registered.
+func NewMapStore(name string, data map[string]string, opts ...cache.Option) *cache.Store {
+	m := make(map[string]string, len(data))
+	for k, v := range data {
+		m[k] = v
+	}
+	getter := cache.GetterFunc(func(key string, dest cache.Sink) error {
+		v, ok := m[key]
+		if !ok {
+			return ErrNotFound
+		}
+		return dest.SetString(v)
+	})
+	if name == "" {
+		return cache.NewUnregisteredStore(DefaultCacheBytes, getter, opts...)
+	}
+	return cache.NewStore(name, DefaultCacheBytes, getter, opts...)
+}
+
+// AssertGet fails t unless getting key from s returns want.
+func AssertGet(t testing.TB, s *cache.Store, key, want string) {
+	t.Helper()
+	got, err := s.GetString(key)
+	if err != nil {
+		t.Errorf("Get(%q): %v", key, err)
+		return
+	}
+	if got != want {
+		t.Errorf("Get(%q) = %q; want %q", key, got, want)
+	}
+}
+
+// AssertGetError fails t unless getting key from s returns an error
+// matching target, as by errors.Is.
+func AssertGetError(t testing.TB, s *cache.Store, key string, target error) {
+	t.Helper()
+	if _, err := s.GetString(key); !errors.Is(err, target) {
+		t.Errorf("Get(%q) error = %v; want %v", key, err, target)
+	}
+}
+
+// AssertCached fails t unless s has a value cached under key.
+func AssertCached(t testing.TB, s *cache.Store, key string) {
+	t.Helper()
+	if _, ok := s.Peek(key); !ok {
+		t.Errorf("%q is not cached", key)
+	}
+}
+
+// AssertNotCached fails t if s has a value cached under key.
+func AssertNotCached(t testing.TB, s *cache.Store, key string) {
+	t.Helper()
+	if v, ok := s.Peek(key); ok {
+		t.Errorf("%q is cached with value %q", key, v.String())
+	}
+}
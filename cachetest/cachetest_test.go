@@ -0,0 +1,31 @@
+package cachetest
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/FeiniuBus/cache"
+)
+
+// runs counts the runs of TestNewMapStore, so that each registers its
+// store under a new name when tests are run more than once.
+var runs int
+
+func TestNewMapStore(t *testing.T) {
+	data := map[string]string{"a": "apple"}
+	s := NewMapStore("", data)
+	data["a"] = "changed"
+
+	AssertNotCached(t, s, "a")
+	AssertGet(t, s, "a", "apple")
+	AssertCached(t, s, "a")
+	AssertGetError(t, s, "b", ErrNotFound)
+	AssertNotCached(t, s, "b")
+
+	runs++
+	name := "cachetest-named-" + strconv.Itoa(runs)
+	named := NewMapStore(name, nil)
+	if cache.GetStore(name) != named {
+		t.Error("named store is not registered")
+	}
+}
@@ -0,0 +1,170 @@
+package clock
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// Cache is a cache using the CLOCK (second-chance) eviction policy.
+// Get only sets the entry's reference bit, atomically, so concurrent
+// calls to Get and Peek are safe as long as no other method runs at
+// the same time. All other methods require exclusive access.
+type Cache struct {
+	MaxEntries int
+	OnEvicted  func(key string, value interface{})
+
+	ll    *list.List
+	hand  *list.Element
+	cache map[string]*list.Element
+}
+
+type entry struct {
+	key   string
+	value interface{}
+	ref   int32
+}
+
+// New creates a new Cache
+func New(maxEntries int) *Cache {
+	return &Cache{
+		MaxEntries: maxEntries,
+		ll:         list.New(),
+		cache:      make(map[string]*list.Element),
+	}
+}
+
+// Add adds a value to the cache.
+func (c *Cache) Add(key string, value interface{}) {
+	if c.cache == nil {
+		c.cache = make(map[string]*list.Element)
+		c.ll = list.New()
+	}
+	if ee, ok := c.cache[key]; ok {
+		kv := ee.Value.(*entry)
+		kv.value = value
+		atomic.StoreInt32(&kv.ref, 1)
+		return
+	}
+	// New entries go just behind the hand, so they are the last
+	// to be considered for eviction.
+	var ele *list.Element
+	if c.hand != nil {
+		ele = c.ll.InsertBefore(&entry{key: key, value: value}, c.hand)
+	} else {
+		ele = c.ll.PushBack(&entry{key: key, value: value})
+	}
+	c.cache[key] = ele
+	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
+		c.RemoveOldest()
+	}
+}
+
+// Get looks up a key's value from the cache and marks it as
+// referenced.
+func (c *Cache) Get(key string) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		kv := ele.Value.(*entry)
+		if atomic.LoadInt32(&kv.ref) == 0 {
+			atomic.StoreInt32(&kv.ref, 1)
+		}
+		return kv.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value from the cache without marking it as
+// referenced.
+func (c *Cache) Peek(key string) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		return ele.Value.(*entry).value, true
+	}
+	return
+}
+
+// Remove removes the provided key from the cache and reports whether
+// it was present.
+func (c *Cache) Remove(key string) bool {
+	if c.cache == nil {
+		return false
+	}
+	if ele, hit := c.cache[key]; hit {
+		c.removeElement(ele)
+		return true
+	}
+	return false
+}
+
+// RemoveOldest advances the clock hand, clearing reference bits, until
+// it finds an unreferenced entry, then removes and returns that entry.
+func (c *Cache) RemoveOldest() (key string, value interface{}, ok bool) {
+	if c.cache == nil || c.ll.Len() == 0 {
+		return
+	}
+	for {
+		if c.hand == nil {
+			c.hand = c.ll.Front()
+		}
+		kv := c.hand.Value.(*entry)
+		if atomic.LoadInt32(&kv.ref) != 0 {
+			atomic.StoreInt32(&kv.ref, 0)
+			c.hand = c.hand.Next()
+			continue
+		}
+		c.removeElement(c.hand)
+		return kv.key, kv.value, true
+	}
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	if e == c.hand {
+		c.hand = e.Next()
+	}
+	c.ll.Remove(e)
+	kv := e.Value.(*entry)
+	delete(c.cache, kv.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
+	}
+}
+
+// Each calls fn for each item in the cache, in no particular order,
+// until fn returns false. It does not mark items as referenced, and fn
+// must not modify the cache.
+func (c *Cache) Each(fn func(key string, value interface{}) bool) {
+	if c.cache == nil {
+		return
+	}
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		kv := e.Value.(*entry)
+		if !fn(kv.key, kv.value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of items in the cache.
+func (c *Cache) Len() int {
+	if c.cache == nil {
+		return 0
+	}
+	return c.ll.Len()
+}
+
+// Clear purges all stored items from the cache.
+func (c *Cache) Clear() {
+	if c.OnEvicted != nil {
+		for _, e := range c.cache {
+			kv := e.Value.(*entry)
+			c.OnEvicted(kv.key, kv.value)
+		}
+	}
+	c.ll = nil
+	c.hand = nil
+	c.cache = nil
+}
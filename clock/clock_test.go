@@ -0,0 +1,67 @@
+package clock
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	c := New(0)
+	c.Add("myKey", 1234)
+	if val, ok := c.Get("myKey"); !ok {
+		t.Fatal("TestGet returned no match")
+	} else if val != 1234 {
+		t.Fatalf("TestGet failed.  Expected %d, got %v", 1234, val)
+	}
+	if _, ok := c.Get("nonsense"); ok {
+		t.Fatal("TestGet returned a match for a missing key")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New(0)
+	c.Add("myKey", 1234)
+	c.Remove("myKey")
+	if _, ok := c.Get("myKey"); ok {
+		t.Fatal("TestRemove returned a removed entry")
+	}
+}
+
+func TestEvictSecondChance(t *testing.T) {
+	evictedKeys := make([]string, 0)
+	c := New(3)
+	c.OnEvicted = func(key string, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Get("a")
+	c.Add("d", 4)
+	c.Add("e", 5)
+
+	if got, want := fmt.Sprint(evictedKeys), "[b c]"; got != want {
+		t.Fatalf("evicted keys = %s; want %s", got, want)
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("referenced key was evicted")
+	}
+}
+
+func TestEvict(t *testing.T) {
+	evictedKeys := make([]string, 0)
+	c := New(20)
+	c.OnEvicted = func(key string, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	}
+	for i := 0; i < 22; i++ {
+		c.Add(fmt.Sprintf("myKey%d", i), 1234)
+	}
+
+	if len(evictedKeys) != 2 {
+		t.Fatalf("got %d evicted keys; want 2", len(evictedKeys))
+	}
+	if evictedKeys[0] != "myKey0" || evictedKeys[1] != "myKey1" {
+		t.Fatalf("evicted keys = %v; want [myKey0 myKey1]", evictedKeys)
+	}
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// requestMemoKey is the context key of a *requestMemo.
+type requestMemoKey struct{}
+
+// requestMemo holds the values read through GetContext while its
+// context is in scope.
+type requestMemo struct {
+	mu     sync.Mutex
+	values map[*Store]map[string]ByteView
+}
+
+// WithRequestMemo returns a context in which GetContext remembers the
+// values it reads, so that repeated reads of a key from a store return
+// the same value without going through the store again. Use one per
+// request: the values are never evicted or reloaded, and are dropped
+// with the context.
+func WithRequestMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestMemoKey{}, &requestMemo{})
+}
+
+// GetContext is like Get, but first checks that ctx is not done, and
+// if ctx was made by WithRequestMemo, serves values already read
+// through it and remembers the values it reads.
+func (s *Store) GetContext(ctx context.Context, key string, dest Sink) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	memo, _ := ctx.Value(requestMemoKey{}).(*requestMemo)
+	if memo == nil || dest == nil {
+		return s.Get(key, dest)
+	}
+	if v, ok := memo.get(s, key); ok {
+		return setSinkView(dest, v)
+	}
+	if err := s.Get(key, dest); err != nil {
+		return err
+	}
+	v, err := dest.view()
+	if err != nil {
+		return err
+	}
+	memo.set(s, key, v)
+	return nil
+}
+
+func (m *requestMemo) get(s *Store, key string) (ByteView, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[s][key]
+	return v, ok
+}
+
+func (m *requestMemo) set(s *Store, key string, v ByteView) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = make(map[*Store]map[string]ByteView)
+	}
+	if m.values[s] == nil {
+		m.values[s] = make(map[string]ByteView)
+	}
+	m.values[s][key] = v
+}
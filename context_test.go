@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetContextMemo(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v-" + key)
+	}))
+	ctx := WithRequestMemo(context.Background())
+	var v string
+	for i := 0; i < 3; i++ {
+		if err := s.GetContext(ctx, "k", StringSink(&v)); err != nil || v != "v-k" {
+			t.Fatalf("GetContext = %q, %v; want %q, nil", v, err, "v-k")
+		}
+	}
+	if n := s.Stats.Gets.Get(); n != 1 {
+		t.Errorf("store Gets = %d; want 1", n)
+	}
+
+	// A new request reads through the store again.
+	if err := s.GetContext(WithRequestMemo(context.Background()), "k", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Stats.Gets.Get(); n != 2 {
+		t.Errorf("store Gets = %d; want 2", n)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.GetContext(cancelled, "k", StringSink(&v)); err != context.Canceled {
+		t.Errorf("GetContext with cancelled context = %v; want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// FailoverGetter returns a Getter that tries each of getters in order
+// until one succeeds. If all of them fail, it returns the last error.
+func FailoverGetter(getters ...Getter) Getter {
+	return FailoverGetterIf(nil, getters...)
+}
+
+// FailoverGetterIf is like FailoverGetter, but stops at the first error
+// for which retryable returns false and returns it. A nil retryable
+// treats every error as retryable.
+func FailoverGetterIf(retryable func(error) bool, getters ...Getter) Getter {
+	if len(getters) == 0 {
+		panic("no Getters")
+	}
+	return &failoverGetter{getters: getters, retryable: retryable}
+}
+
+type failoverGetter struct {
+	getters   []Getter
+	retryable func(error) bool
+}
+
+func (g *failoverGetter) Get(key string, dest Sink) error {
+	var err error
+	for _, getter := range g.getters {
+		err = getter.Get(key, dest)
+		if err == nil {
+			return nil
+		}
+		// A value the getter asked not to be cached is still a value.
+		var dc *dontCacheError
+		if errors.As(err, &dc) {
+			return err
+		}
+		if g.retryable != nil && !g.retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// RetryGetter returns a Getter that calls g up to attempts times until
+// it succeeds, sleeping for backoff(n) after the nth failed attempt.
+// A nil backoff retries immediately. As the Store runs its getter
+// inside its duplicate suppression, concurrent callers for a key share
+// a single sequence of retries.
+func RetryGetter(g Getter, attempts int, backoff func(attempt int) time.Duration) Getter {
+	if g == nil {
+		panic("nil Getter")
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &retryGetter{g: g, attempts: attempts, backoff: backoff}
+}
+
+type retryGetter struct {
+	g        Getter
+	attempts int
+	backoff  func(attempt int) time.Duration
+}
+
+func (g *retryGetter) Get(key string, dest Sink) error {
+	var err error
+	for n := 1; ; n++ {
+		err = g.g.Get(key, dest)
+		if err == nil || n == g.attempts {
+			return err
+		}
+		var dc *dontCacheError
+		if errors.As(err, &dc) {
+			return err
+		}
+		if g.backoff != nil {
+			time.Sleep(g.backoff(n))
+		}
+	}
+}
+
+// A Middleware wraps a Getter to add behavior around its loads.
+type Middleware func(Getter) Getter
+
+// Chain wraps g in each of mw, the first being outermost: Chain(g, a, b)
+// returns a(b(g)), so a load runs through a, then b, then g.
+func Chain(g Getter, mw ...Middleware) Getter {
+	if g == nil {
+		panic("nil Getter")
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		g = mw[i](g)
+	}
+	return g
+}
+
+// ErrCircuitOpen is returned by a CircuitBreakerGetter instead of
+// calling its getter while the circuit is open.
+var ErrCircuitOpen = errors.New("cache: circuit open")
+
+// BreakerOptions configure a CircuitBreakerGetter.
+type BreakerOptions struct {
+	// Threshold is the number of consecutive failures that opens the
+	// circuit. Values below 1 mean 1.
+	Threshold int
+
+	// Cooldown is how long the circuit stays open before a single
+	// probe load is let through.
+	Cooldown time.Duration
+
+	// IsFailure reports whether an error counts as a failure. If nil,
+	// every error counts, except those made with DontCache.
+	IsFailure func(error) bool
+
+	// Logger, if set, is told when the circuit opens and closes.
+	Logger Logger
+}
+
+// CircuitBreakerGetter returns a Getter that stops calling g after
+// opts.Threshold consecutive failures, failing fast with ErrCircuitOpen
+// for opts.Cooldown. Then the circuit is half-open: one load is passed
+// to g while the others keep failing fast. If it succeeds the circuit
+// closes, and if it fails the circuit opens for another cooldown.
+func CircuitBreakerGetter(g Getter, opts BreakerOptions) Getter {
+	if g == nil {
+		panic("nil Getter")
+	}
+	if opts.Threshold < 1 {
+		opts.Threshold = 1
+	}
+	return &breakerGetter{g: g, opts: opts}
+}
+
+type breakerGetter struct {
+	g    Getter
+	opts BreakerOptions
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero while closed
+
+	// probe is the token of the half-open probe in flight, or 0, and
+	// lastProbe the last token handed out.
+	probe     uint64
+	lastProbe uint64
+}
+
+func (g *breakerGetter) Get(key string, dest Sink) error {
+	ok, probe := g.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	if probe != 0 {
+		// Deferred so that a probe that panics doesn't hold the
+		// circuit open forever.
+		defer g.endProbe(probe)
+	}
+	err := g.g.Get(key, dest)
+	if opened, closed := g.record(err); g.opts.Logger != nil {
+		if opened {
+			g.opts.Logger.Printf("cache: circuit opened for %v: %v", g.opts.Cooldown, err)
+		} else if closed {
+			g.opts.Logger.Printf("cache: circuit closed")
+		}
+	}
+	return err
+}
+
+// allow reports whether a load may go through. If the circuit is
+// half-open, the load is the probe, and probe is its token, to be
+// passed to endProbe once it is done.
+func (g *breakerGetter) allow() (ok bool, probe uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.openedAt.IsZero() {
+		return true, 0
+	}
+	if g.probe != 0 || time.Since(g.openedAt) < g.opts.Cooldown {
+		return false, 0
+	}
+	g.lastProbe++
+	g.probe = g.lastProbe
+	return true, g.probe
+}
+
+// endProbe ends the probe with the given token, letting another one
+// through while the circuit stays open.
+func (g *breakerGetter) endProbe(probe uint64) {
+	g.mu.Lock()
+	if g.probe == probe {
+		g.probe = 0
+	}
+	g.mu.Unlock()
+}
+
+// record counts the result of a load, and reports whether it opened or
+// closed the circuit.
+func (g *breakerGetter) record(err error) (opened, closed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.isFailure(err) {
+		closed = !g.openedAt.IsZero()
+		g.failures = 0
+		g.openedAt = time.Time{}
+		return false, closed
+	}
+	g.failures++
+	if g.failures >= g.opts.Threshold {
+		g.openedAt = time.Now()
+		return true, false
+	}
+	return false, false
+}
+
+func (g *breakerGetter) isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if g.opts.IsFailure != nil {
+		return g.opts.IsFailure(err)
+	}
+	var dc *dontCacheError
+	return !errors.As(err, &dc)
+}
+
+// StoreGetter returns a Getter that loads key from src and passes the
+// value to transform to populate dest, so that one Store can load its
+// values from another. Each Store keeps its own cache and duplicate
+// suppression. A nil transform populates dest with src's value as is.
+func StoreGetter(src *Store, transform func(key string, v ByteView, dest Sink) error) Getter {
+	if src == nil {
+		panic("nil Store")
+	}
+	return &storeGetter{src: src, transform: transform}
+}
+
+type storeGetter struct {
+	src       *Store
+	transform func(key string, v ByteView, dest Sink) error
+}
+
+func (g *storeGetter) Get(key string, dest Sink) error {
+	var v ByteView
+	if err := g.src.Get(key, ByteViewSink(&v)); err != nil {
+		return err
+	}
+	if g.transform == nil {
+		return setSinkView(dest, v)
+	}
+	return g.transform(key, v, dest)
+}
@@ -0,0 +1,266 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailoverGetter(t *testing.T) {
+	down := errors.New("down")
+	fatal := errors.New("fatal")
+	failing := func(err error) Getter {
+		return GetterFunc(func(key string, dest Sink) error {
+			return err
+		})
+	}
+	echo := GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("ECHO: " + key)
+	})
+
+	var v string
+	if err := FailoverGetter(failing(down), failing(down), echo).Get("key", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if v != "ECHO: key" {
+		t.Errorf("got %q; want %q", v, "ECHO: key")
+	}
+
+	if err := FailoverGetter(failing(down), failing(fatal)).Get("key", StringSink(&v)); err != fatal {
+		t.Errorf("error = %v; want last error %v", err, fatal)
+	}
+
+	retryable := func(err error) bool { return err != fatal }
+	if err := FailoverGetterIf(retryable, failing(fatal), echo).Get("key", StringSink(&v)); err != fatal {
+		t.Errorf("error = %v; want non-retryable error %v", err, fatal)
+	}
+}
+
+func TestRetryGetter(t *testing.T) {
+	flaky := errors.New("flaky")
+	var calls int
+	g := GetterFunc(func(key string, dest Sink) error {
+		calls++
+		if calls < 3 {
+			return flaky
+		}
+		return dest.SetString("ECHO: " + key)
+	})
+
+	var backoffs []int
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	var v string
+	if err := RetryGetter(g, 2, backoff).Get("key", StringSink(&v)); err != flaky {
+		t.Errorf("error = %v; want %v after 2 attempts", err, flaky)
+	}
+	calls = 0
+	if err := RetryGetter(g, 3, backoff).Get("key", StringSink(&v)); err != nil {
+		t.Errorf("error = %v; want success on 3rd attempt", err)
+	}
+	if want := []int{1, 1, 2}; !reflect.DeepEqual(backoffs, want) {
+		t.Errorf("backoff attempts = %v; want %v", backoffs, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Getter) Getter {
+			return GetterFunc(func(key string, dest Sink) error {
+				order = append(order, name)
+				return next.Get(key, dest)
+			})
+		}
+	}
+	g := GetterFunc(func(key string, dest Sink) error {
+		order = append(order, "getter")
+		return dest.SetString(key)
+	})
+
+	var v string
+	if err := Chain(g, trace("a"), trace("b")).Get("key", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "getter"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v; want %v", order, want)
+	}
+}
+
+func TestCircuitBreakerGetter(t *testing.T) {
+	down := errors.New("down")
+	var calls int
+	var fail bool
+	g := CircuitBreakerGetter(GetterFunc(func(key string, dest Sink) error {
+		calls++
+		if fail {
+			return down
+		}
+		return dest.SetString(key)
+	}), BreakerOptions{Threshold: 2, Cooldown: 20 * time.Millisecond})
+
+	var v string
+	fail = true
+	for i := 0; i < 2; i++ {
+		if err := g.Get("key", StringSink(&v)); err != down {
+			t.Fatalf("Get #%d = %v; want %v", i, err, down)
+		}
+	}
+	if err := g.Get("key", StringSink(&v)); err != ErrCircuitOpen {
+		t.Fatalf("Get with open circuit = %v; want ErrCircuitOpen", err)
+	}
+	if calls != 2 {
+		t.Errorf("getter called %d times; want 2", calls)
+	}
+
+	// A failed probe reopens the circuit.
+	time.Sleep(30 * time.Millisecond)
+	if err := g.Get("key", StringSink(&v)); err != down {
+		t.Fatalf("probe = %v; want %v", err, down)
+	}
+	if err := g.Get("key", StringSink(&v)); err != ErrCircuitOpen {
+		t.Fatalf("Get after failed probe = %v; want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it.
+	time.Sleep(30 * time.Millisecond)
+	fail = false
+	for i := 0; i < 2; i++ {
+		if err := g.Get("key", StringSink(&v)); err != nil {
+			t.Fatalf("Get #%d after recovery = %v", i, err)
+		}
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	down := errors.New("down")
+	started := make(chan string)
+	release := map[string]chan struct{}{"slow": make(chan struct{}), "probe": make(chan struct{})}
+	var calls AtomicInt
+	g := CircuitBreakerGetter(GetterFunc(func(key string, dest Sink) error {
+		calls.Add(1)
+		if key == "panic" {
+			panic("boom")
+		}
+		if ch, ok := release[key]; ok {
+			started <- key
+			<-ch
+		}
+		return down
+	}), BreakerOptions{Threshold: 1, Cooldown: 20 * time.Millisecond})
+
+	var v string
+	errc := make(chan error)
+	get := func(key string) {
+		errc <- g.Get(key, StringSink(&v))
+	}
+	// A load let through while closed finishes during the probe.
+	go get("slow")
+	<-started
+	if err := g.Get("fail", StringSink(&v)); err != down {
+		t.Fatalf("Get = %v; want %v", err, down)
+	}
+	time.Sleep(30 * time.Millisecond)
+	go get("probe")
+	<-started
+	close(release["slow"])
+	<-errc
+	// The slow load's failure reopened the circuit; once that cooldown
+	// passes, the probe is still in flight and no other may start.
+	time.Sleep(30 * time.Millisecond)
+	if err := g.Get("other", StringSink(&v)); err != ErrCircuitOpen {
+		t.Errorf("Get during the probe = %v; want ErrCircuitOpen", err)
+	}
+	close(release["probe"])
+	<-errc
+
+	// A probe that panics doesn't leave the circuit open for good.
+	time.Sleep(30 * time.Millisecond)
+	func() {
+		defer func() { recover() }()
+		g.Get("panic", StringSink(&v))
+	}()
+	before := calls.Get()
+	if err := g.Get("other", StringSink(&v)); err != down {
+		t.Errorf("Get after a panicking probe = %v; want a new probe's %v", err, down)
+	}
+	if calls.Get() != before+1 {
+		t.Error("no probe after a panicking one")
+	}
+}
+
+func TestStoreGetter(t *testing.T) {
+	var srcLoads, dstLoads int
+	src := NewUnregisteredStore(1<<20, GetterFunc(func(key string, dest Sink) error {
+		srcLoads++
+		return dest.SetString("src:" + key)
+	}))
+	upper := func(key string, v ByteView, dest Sink) error {
+		dstLoads++
+		return dest.SetString(strings.ToUpper(v.String()))
+	}
+	dst := NewUnregisteredStore(1<<20, StoreGetter(src, upper))
+
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := dst.Get("k", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if s != "SRC:K" {
+			t.Errorf("Get = %q; want %q", s, "SRC:K")
+		}
+	}
+	if srcLoads != 1 || dstLoads != 1 {
+		t.Errorf("loads = %d, %d; want 1, 1", srcLoads, dstLoads)
+	}
+
+	// The source's cache serves a second layer without loading again.
+	dst.Flush()
+	var s string
+	if err := dst.Get("k", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if srcLoads != 1 || dstLoads != 2 {
+		t.Errorf("loads after Flush = %d, %d; want 1, 2", srcLoads, dstLoads)
+	}
+
+	plain := NewUnregisteredStore(1<<20, StoreGetter(src, nil))
+	if err := plain.Get("k", StringSink(&s)); err != nil || s != "src:k" {
+		t.Errorf("Get with nil transform = %q, %v", s, err)
+	}
+
+	fail := errors.New("fail")
+	bad := NewUnregisteredStore(1<<20, StoreGetter(NewUnregisteredStore(1<<20, GetterFunc(func(key string, dest Sink) error {
+		return fail
+	})), upper))
+	if err := bad.Get("k", StringSink(&s)); !errors.Is(err, fail) {
+		t.Errorf("Get error = %v; want %v", err, fail)
+	}
+}
+
+func TestCircuitBreakerLogger(t *testing.T) {
+	l := new(testLogger)
+	fail := true
+	g := CircuitBreakerGetter(GetterFunc(func(key string, dest Sink) error {
+		if fail {
+			return errors.New("down")
+		}
+		return dest.SetString(key)
+	}), BreakerOptions{Threshold: 1, Cooldown: time.Millisecond, Logger: l})
+	var v string
+	g.Get("key", StringSink(&v))
+	time.Sleep(2 * time.Millisecond)
+	fail = false
+	if err := g.Get("key", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cache: circuit opened for 1ms: down", "cache: circuit closed"}
+	if !reflect.DeepEqual(l.lines, want) {
+		t.Errorf("logged %q; want %q", l.lines, want)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/FeiniuBus/cache
+
+go 1.20
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// A KeyStat is the number of times loads of a key were deduplicated.
+type KeyStat struct {
+	Key    string
+	Dedups int64
+}
+
+// hotKeys estimates the keys with the most deduplicated loads using
+// the Space-Saving algorithm: it tracks at most size keys, and a new
+// key replaces the tracked key with the lowest count, inheriting that
+// count. Counts may thus overestimate, by at most the lowest count, but
+// any key with more dedups than that is always tracked.
+type hotKeys struct {
+	mu    sync.Mutex
+	size  int
+	index map[string]*hotKey
+	h     hotKeyHeap
+}
+
+type hotKey struct {
+	KeyStat
+	i int // index in the heap
+}
+
+func newHotKeys(size int) *hotKeys {
+	return &hotKeys{size: size, index: make(map[string]*hotKey, size)}
+}
+
+func (hk *hotKeys) add(key string) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	if k, ok := hk.index[key]; ok {
+		k.Dedups++
+		heap.Fix(&hk.h, k.i)
+		return
+	}
+	if len(hk.h) < hk.size {
+		k := &hotKey{KeyStat: KeyStat{Key: key, Dedups: 1}}
+		hk.index[key] = k
+		heap.Push(&hk.h, k)
+		return
+	}
+	k := hk.h[0]
+	delete(hk.index, k.Key)
+	k.Key = key
+	k.Dedups++
+	hk.index[key] = k
+	heap.Fix(&hk.h, 0)
+}
+
+func (hk *hotKeys) top(n int) []KeyStat {
+	hk.mu.Lock()
+	stats := make([]KeyStat, len(hk.h))
+	for i, k := range hk.h {
+		stats[i] = k.KeyStat
+	}
+	hk.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Dedups > stats[j].Dedups })
+	if n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// hotKeyHeap is a min-heap of tracked keys by count.
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].Dedups < h[j].Dedups }
+
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i = i
+	h[j].i = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	k := x.(*hotKey)
+	k.i = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
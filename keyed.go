@@ -0,0 +1,46 @@
+package cache
+
+import "fmt"
+
+// A KeyedStore is a view of a Store whose keys are values of type K
+// rather than strings. Each key is converted to the string key of the
+// underlying Store with the KeyedStore's key function, so the getter
+// sees the converted key.
+type KeyedStore[K comparable] struct {
+	store *Store
+	keyFn func(K) string
+}
+
+// NewKeyedStore returns a KeyedStore over s that converts keys with
+// keyFn. If keyFn is nil, keys are formatted with the %#v verb, which
+// quotes strings and names struct fields so distinct keys don't
+// collide by accident.
+func NewKeyedStore[K comparable](s *Store, keyFn func(K) string) *KeyedStore[K] {
+	if s == nil {
+		panic("nil Store")
+	}
+	if keyFn == nil {
+		keyFn = func(key K) string { return fmt.Sprintf("%#v", key) }
+	}
+	return &KeyedStore[K]{store: s, keyFn: keyFn}
+}
+
+// Key returns the string key used in the underlying Store for key.
+func (s *KeyedStore[K]) Key(key K) string {
+	return s.keyFn(key)
+}
+
+// Get is like Store.Get with key converted.
+func (s *KeyedStore[K]) Get(key K, dest Sink) error {
+	return s.store.Get(s.keyFn(key), dest)
+}
+
+// Set is like Store.Set with key converted.
+func (s *KeyedStore[K]) Set(key K, value ByteView) {
+	s.store.Set(s.keyFn(key), value)
+}
+
+// Remove is like Store.Remove with key converted.
+func (s *KeyedStore[K]) Remove(key K) {
+	s.store.Remove(s.keyFn(key))
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"math/bits"
+	"time"
+)
+
+// latencyBuckets is the number of buckets in a LatencyHistogram.
+const latencyBuckets = 26
+
+// A LatencyHistogram counts durations in buckets by powers of two of
+// microseconds. Counts[0] is the number of durations under 1µs, and
+// Counts[i] for 0 < i < len(Counts)-1 is the number from 2^(i-1)µs up
+// to 2^iµs. The last bucket counts everything longer, from about 16.8s.
+type LatencyHistogram struct {
+	Counts [latencyBuckets]int64
+}
+
+// BucketLimit returns the exclusive upper bound of the durations
+// counted in bucket i, or 0 for the last, unbounded bucket.
+func BucketLimit(i int) time.Duration {
+	if i >= latencyBuckets-1 {
+		return 0
+	}
+	return time.Duration(1<<uint(i)) * time.Microsecond
+}
+
+// Count returns the number of durations in h.
+func (h LatencyHistogram) Count() int64 {
+	var n int64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns an upper bound of the q-quantile of the durations
+// in h, for q from 0 to 1: the limit of the bucket holding it. If that
+// is the last bucket, Quantile returns its lower bound instead. It
+// returns 0 if h is empty.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(q * float64(n))
+	if rank >= n {
+		rank = n - 1
+	}
+	var seen int64
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank {
+			if i == latencyBuckets-1 {
+				return BucketLimit(i - 1)
+			}
+			return BucketLimit(i)
+		}
+	}
+	return BucketLimit(latencyBuckets - 2)
+}
+
+// latencyRecorder is a LatencyHistogram updated atomically.
+type latencyRecorder [latencyBuckets]AtomicInt
+
+func (r *latencyRecorder) record(d time.Duration) {
+	i := 0
+	if us := d.Microseconds(); us > 0 {
+		i = bits.Len64(uint64(us))
+	}
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	r[i].Add(1)
+}
+
+func (r *latencyRecorder) snapshot() LatencyHistogram {
+	var h LatencyHistogram
+	for i := range r {
+		h.Counts[i] = r[i].Get()
+	}
+	return h
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var r latencyRecorder
+	for _, d := range []time.Duration{
+		0,
+		500 * time.Nanosecond,
+		3 * time.Microsecond,
+		3 * time.Microsecond,
+		time.Millisecond,
+		time.Minute,
+	} {
+		r.record(d)
+	}
+	h := r.snapshot()
+	if n := h.Count(); n != 6 {
+		t.Fatalf("Count = %d; want 6", n)
+	}
+	if h.Counts[0] != 2 || h.Counts[2] != 2 || h.Counts[latencyBuckets-1] != 1 {
+		t.Errorf("Counts = %v", h.Counts)
+	}
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{0.5, 4 * time.Microsecond},
+		{0.8, 1024 * time.Microsecond},
+		{1, BucketLimit(latencyBuckets - 2)},
+	} {
+		if got := h.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v; want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestLoadLatency(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}))
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetString("k"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.LoadLatency().Count(); n != 1 {
+		t.Errorf("LoadLatency().Count() = %d; want 1", n)
+	}
+	s.ResetStats()
+	if n := s.LoadLatency().Count(); n != 0 {
+		t.Errorf("after ResetStats, Count() = %d; want 0", n)
+	}
+}
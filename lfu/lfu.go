@@ -0,0 +1,246 @@
+// Package lfu implements a least-frequently-used cache whose access
+// counts decay over time.
+package lfu
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Cache is a cache that evicts the entry with the fewest accesses,
+// breaking ties by evicting the least recently used. If DecayInterval
+// is set, all access counts are halved once per interval, so entries
+// that were hot long ago but are rarely used now eventually become
+// the first to go.
+//
+// The most recently added entry is on probation: it is only evicted
+// once another entry has been added, or if it is the only entry. A new
+// entry starts with a single access and would otherwise always be the
+// entry with the fewest, evicted by the next Add before a second access
+// could count; on probation, a key that is hit again before the next
+// Add can enter a cache full of entries with higher counts.
+//
+// It is not safe for concurrent access.
+type Cache struct {
+	MaxEntries    int
+	OnEvicted     func(key string, value interface{})
+	DecayInterval time.Duration
+
+	h         entryHeap
+	cache     map[string]*entry
+	seq       uint64 // incremented on every access, for recency
+	lastDecay time.Time
+
+	// newest is the entry on probation, or nil.
+	newest *entry
+}
+
+type entry struct {
+	key   string
+	value interface{}
+	count uint64
+	seq   uint64
+	i     int // index in the heap
+}
+
+// New creates a new Cache
+func New(maxEntries int) *Cache {
+	return &Cache{
+		MaxEntries: maxEntries,
+		cache:      make(map[string]*entry),
+	}
+}
+
+// Add adds a value to the cache, counting an access to it.
+func (c *Cache) Add(key string, value interface{}) {
+	if c.cache == nil {
+		c.cache = make(map[string]*entry)
+	}
+	c.maybeDecay()
+	if e, ok := c.cache[key]; ok {
+		e.value = value
+		c.touch(e)
+		return
+	}
+	c.seq++
+	e := &entry{key: key, value: value, count: 1, seq: c.seq}
+	c.cache[key] = e
+	heap.Push(&c.h, e)
+	c.newest = e
+	if c.MaxEntries != 0 && len(c.h) > c.MaxEntries {
+		c.RemoveOldest()
+	}
+}
+
+// Get looks up a key's value from the cache, counting an access to it.
+func (c *Cache) Get(key string) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	c.maybeDecay()
+	if e, hit := c.cache[key]; hit {
+		c.touch(e)
+		return e.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value from the cache without counting an
+// access to it.
+func (c *Cache) Peek(key string) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if e, hit := c.cache[key]; hit {
+		return e.value, true
+	}
+	return
+}
+
+func (c *Cache) touch(e *entry) {
+	e.count++
+	c.seq++
+	e.seq = c.seq
+	heap.Fix(&c.h, e.i)
+}
+
+// Remove removes the provided key from the cache and reports whether
+// it was present.
+func (c *Cache) Remove(key string) bool {
+	if c.cache == nil {
+		return false
+	}
+	if e, hit := c.cache[key]; hit {
+		heap.Remove(&c.h, e.i)
+		c.removed(e)
+		return true
+	}
+	return false
+}
+
+// Oldest returns the item RemoveOldest would remove, without removing
+// it.
+func (c *Cache) Oldest() (key string, value interface{}, ok bool) {
+	if len(c.h) == 0 {
+		return
+	}
+	e := c.h[c.victim()]
+	return e.key, e.value, true
+}
+
+// RemoveOldest removes the least frequently used item from the cache
+// and returns it.
+func (c *Cache) RemoveOldest() (key string, value interface{}, ok bool) {
+	if len(c.h) == 0 {
+		return
+	}
+	e := heap.Remove(&c.h, c.victim()).(*entry)
+	c.removed(e)
+	return e.key, e.value, true
+}
+
+// victim returns the heap index of the entry to evict: the least
+// frequently used one, unless that is on probation and there are
+// others, in which case it is the lesser of its children.
+func (c *Cache) victim() int {
+	if c.h[0] != c.newest || len(c.h) == 1 {
+		return 0
+	}
+	if len(c.h) == 2 || c.h.Less(1, 2) {
+		return 1
+	}
+	return 2
+}
+
+func (c *Cache) removed(e *entry) {
+	if c.newest == e {
+		c.newest = nil
+	}
+	delete(c.cache, e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+// Decay halves the access count of every item.
+func (c *Cache) Decay() {
+	for _, e := range c.h {
+		e.count /= 2
+	}
+	heap.Init(&c.h)
+}
+
+func (c *Cache) maybeDecay() {
+	if c.DecayInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	if c.lastDecay.IsZero() {
+		c.lastDecay = now
+		return
+	}
+	if now.Sub(c.lastDecay) >= c.DecayInterval {
+		c.Decay()
+		c.lastDecay = now
+	}
+}
+
+// Each calls fn for each item in the cache, in no particular order,
+// until fn returns false. It does not count accesses, and fn must not
+// modify the cache.
+func (c *Cache) Each(fn func(key string, value interface{}) bool) {
+	for _, e := range c.h {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of items in the cache.
+func (c *Cache) Len() int {
+	return len(c.h)
+}
+
+// Clear purges all stored items from the cache.
+func (c *Cache) Clear() {
+	if c.OnEvicted != nil {
+		for _, e := range c.h {
+			c.OnEvicted(e.key, e.value)
+		}
+	}
+	c.h = nil
+	c.cache = nil
+	c.newest = nil
+}
+
+// entryHeap is a min-heap of entries by count, then by recency.
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i = i
+	h[j].i = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.i = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,128 @@
+package lfu
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	c := New(0)
+	c.Add("myKey", 1234)
+	if val, ok := c.Get("myKey"); !ok {
+		t.Fatal("TestGet returned no match")
+	} else if val != 1234 {
+		t.Fatalf("TestGet failed.  Expected %d, got %v", 1234, val)
+	}
+	if _, ok := c.Get("nonsense"); ok {
+		t.Fatal("TestGet returned a match for a missing key")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New(0)
+	c.Add("myKey", 1234)
+	if !c.Remove("myKey") {
+		t.Fatal("Remove of a present key reported false")
+	}
+	if _, ok := c.Get("myKey"); ok {
+		t.Fatal("TestRemove returned a removed entry")
+	}
+	if c.Remove("myKey") {
+		t.Fatal("Remove of an absent key reported true")
+	}
+}
+
+func TestEvictLeastFrequent(t *testing.T) {
+	var evicted []string
+	c := New(3)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Get("a")
+	c.Get("a")
+	c.Get("c")
+	c.Add("d", 4) // b has the fewest accesses
+	c.Add("e", 5) // d and e have one access each; d is older
+	if got, want := fmt.Sprint(evicted), "[b d]"; got != want {
+		t.Fatalf("evicted keys = %s; want %s", got, want)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	c := New(0)
+	c.Add("once-hot", 1)
+	for i := 0; i < 7; i++ {
+		c.Get("once-hot")
+	}
+	c.Add("steady", 2)
+	for round := 0; round < 4; round++ {
+		c.Decay()
+		c.Get("steady")
+	}
+	if key, _, _ := c.Oldest(); key != "once-hot" {
+		t.Fatalf("Oldest = %q after decay; want %q", key, "once-hot")
+	}
+}
+
+func TestDecayInterval(t *testing.T) {
+	c := &Cache{DecayInterval: time.Millisecond}
+	c.Add("a", 1)
+	c.Get("a")
+	c.Get("a")
+	time.Sleep(2 * time.Millisecond)
+	c.Get("a") // decays 3 to 1, then counts to 2
+	if e := c.cache["a"]; e.count != 2 {
+		t.Fatalf("count = %d after decay; want 2", e.count)
+	}
+}
+
+func TestClear(t *testing.T) {
+	var evicted int
+	c := New(0)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted++
+	}
+	for i := 0; i < 5; i++ {
+		c.Add(fmt.Sprintf("myKey%d", i), i)
+	}
+	c.Clear()
+	if evicted != 5 {
+		t.Fatalf("OnEvicted called %d times; want 5", evicted)
+	}
+	if n := c.Len(); n != 0 {
+		t.Fatalf("Len = %d after Clear; want 0", n)
+	}
+	c.Add("myKey", 1)
+	if _, ok := c.Get("myKey"); !ok {
+		t.Fatal("Add after Clear did not store the entry")
+	}
+}
+
+func TestNewEntryProbation(t *testing.T) {
+	var evicted []string
+	c := New(2)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Get("b")
+	// new has the fewest accesses, but is on probation, so a goes.
+	c.Add("new", 3)
+	if got, want := fmt.Sprint(evicted), "[a]"; got != want {
+		t.Fatalf("evicted keys = %s; want %s", got, want)
+	}
+	if key, _, _ := c.Oldest(); key != "b" {
+		t.Errorf("Oldest = %q; want b", key)
+	}
+	c.Add("new", 3)
+	c.Add("other", 4) // new was hit again and outlasts b
+	if got, want := fmt.Sprint(evicted), "[a b]"; got != want {
+		t.Fatalf("evicted keys = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+package cache
+
+// A Logger receives diagnostics that have no caller to be returned to,
+// such as failures of a secondary store. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// nopLogger is the Logger of a store without WithLogger.
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, args ...interface{}) {}
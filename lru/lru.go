@@ -57,25 +57,56 @@ func (c *Cache) Get(key string) (value interface{}, ok bool) {
 	return
 }
 
-// Remove removes the provided key from the cache.
-func (c *Cache) Remove(key string) {
+// Peek looks up a key's value from the cache without updating
+// its recency.
+func (c *Cache) Peek(key string) (value interface{}, ok bool) {
 	if c.cache == nil {
 		return
 	}
+	if ele, hit := c.cache[key]; hit {
+		return ele.Value.(*entry).value, true
+	}
+	return
+}
+
+// Remove removes the provided key from the cache and reports whether
+// it was present.
+func (c *Cache) Remove(key string) bool {
+	if c.cache == nil {
+		return false
+	}
 	if ele, hit := c.cache[key]; hit {
 		c.removeElement(ele)
+		return true
 	}
+	return false
 }
 
-// RemoveOldest removes the oldest item from the cache.
-func (c *Cache) RemoveOldest() {
+// Oldest returns the oldest item in the cache, the next to be removed
+// by RemoveOldest, without removing it.
+func (c *Cache) Oldest() (key string, value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele := c.ll.Back(); ele != nil {
+		kv := ele.Value.(*entry)
+		return kv.key, kv.value, true
+	}
+	return
+}
+
+// RemoveOldest removes the oldest item from the cache and returns it.
+func (c *Cache) RemoveOldest() (key string, value interface{}, ok bool) {
 	if c.cache == nil {
 		return
 	}
 	ele := c.ll.Back()
 	if ele != nil {
 		c.removeElement(ele)
+		kv := ele.Value.(*entry)
+		return kv.key, kv.value, true
 	}
+	return
 }
 
 func (c *Cache) removeElement(e *list.Element) {
@@ -87,6 +118,21 @@ func (c *Cache) removeElement(e *list.Element) {
 	}
 }
 
+// Each calls fn for each item in the cache, from the most to the least
+// recently used, until fn returns false. It does not update recency,
+// and fn must not modify the cache.
+func (c *Cache) Each(fn func(key string, value interface{}) bool) {
+	if c.cache == nil {
+		return
+	}
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		kv := e.Value.(*entry)
+		if !fn(kv.key, kv.value) {
+			return
+		}
+	}
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
 	if c.cache == nil {
@@ -37,10 +37,15 @@ func TestRemove(t *testing.T) {
 		t.Fatalf("TestRemove failed.  Expected %d, got %v", 1234, val)
 	}
 
-	lru.Remove("myKey")
+	if !lru.Remove("myKey") {
+		t.Fatal("TestRemove did not find the entry to remove")
+	}
 	if _, ok := lru.Get("myKey"); ok {
 		t.Fatal("TestRemove returned a removed entry")
 	}
+	if lru.Remove("myKey") {
+		t.Fatal("TestRemove removed an entry twice")
+	}
 }
 
 func TestEvict(t *testing.T) {
@@ -65,3 +70,87 @@ func TestEvict(t *testing.T) {
 		t.Fatalf("got %v in second evicted key; want %s", evictedKeys[1], "myKey1")
 	}
 }
+
+func TestEach(t *testing.T) {
+	lru := New(0)
+	for _, key := range []string{"a", "b", "c"} {
+		lru.Add(key, key)
+	}
+	lru.Get("a")
+
+	var keys []string
+	lru.Each(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if got, want := fmt.Sprint(keys), "[a c b]"; got != want {
+		t.Fatalf("Each visited %s; want %s", got, want)
+	}
+
+	keys = nil
+	lru.Each(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if got, want := fmt.Sprint(keys), "[a c]"; got != want {
+		t.Fatalf("Each visited %s after stopping; want %s", got, want)
+	}
+}
+
+func TestRemoveEvicts(t *testing.T) {
+	var evicted []string
+	lru := New(0)
+	lru.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	lru.Add("a", 1)
+	lru.Add("b", 2)
+	lru.Add("c", 3)
+	lru.Remove("b")
+
+	if got, want := fmt.Sprint(evicted), "[b]"; got != want {
+		t.Fatalf("evicted keys = %s; want %s", got, want)
+	}
+	if key, _, _ := lru.RemoveOldest(); key != "a" {
+		t.Fatalf("RemoveOldest removed %q; want %q", key, "a")
+	}
+}
+
+func TestOldest(t *testing.T) {
+	lru := New(0)
+	if _, _, ok := lru.Oldest(); ok {
+		t.Fatal("Oldest of an empty cache returned an item")
+	}
+	lru.Add("a", 1)
+	lru.Add("b", 2)
+	lru.Get("a")
+	if key, value, ok := lru.Oldest(); !ok || key != "b" || value != 2 {
+		t.Fatalf("Oldest = %q, %v, %v; want b, 2, true", key, value, ok)
+	}
+	if n := lru.Len(); n != 2 {
+		t.Fatalf("Len = %d after Oldest; want 2", n)
+	}
+}
+
+func TestClear(t *testing.T) {
+	var evicted int
+	lru := New(0)
+	lru.OnEvicted = func(key string, value interface{}) {
+		evicted++
+	}
+	for i := 0; i < 5; i++ {
+		lru.Add(fmt.Sprintf("myKey%d", i), i)
+	}
+	lru.Clear()
+
+	if evicted != 5 {
+		t.Fatalf("OnEvicted called %d times; want 5", evicted)
+	}
+	if n := lru.Len(); n != 0 {
+		t.Fatalf("Len = %d after Clear; want 0", n)
+	}
+	lru.Add("myKey", 1)
+	if _, ok := lru.Get("myKey"); !ok {
+		t.Fatal("Add after Clear did not store the entry")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package cache
+
+import "errors"
+
+// offHeapSupported is whether WithOffHeapStorage takes effect. Without
+// mmap it doesn't, and values stay plain heap values.
+const offHeapSupported = false
+
+// offHeapArena stands in for the mmap-backed arena on platforms
+// without mmap. It is never used, as WithOffHeapStorage has no effect.
+type offHeapArena struct{}
+
+func (a *offHeapArena) alloc(n int) ([]byte, error) {
+	return nil, errors.New("cache: off-heap storage is not supported")
+}
+
+func (a *offHeapArena) free(b []byte) {}
@@ -0,0 +1,161 @@
+//go:build unix
+
+package cache
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// slabSize is the size of the mappings small values are carved
+	// from. Slabs are aligned to it, so that the slab holding a value
+	// is found from the value's address.
+	slabSize = 1 << 20
+
+	// minSlotSize and maxSlotSize bound the power-of-two size classes
+	// of the slots carved from slabs. Larger values get a mapping each.
+	minSlotSize = 16
+	maxSlotSize = 64 << 10
+
+	numSizeClasses = 13 // minSlotSize << (numSizeClasses-1) == maxSlotSize
+)
+
+// offHeapSupported is whether WithOffHeapStorage takes effect.
+const offHeapSupported = true
+
+// offHeapArena allocates the off-heap memory of a cache shard. Values
+// of up to maxSlotSize bytes get a slot of the next power-of-two size
+// in a slab shared with values of that size class, so that millions of
+// small values take few mappings; larger values get a page-rounded
+// mapping each. The capacity of an allocation is the memory it takes.
+// An arena is not safe for concurrent use; a shard uses it under its
+// lock.
+type offHeapArena struct {
+	// partial holds, for each size class, the slabs with free slots.
+	partial [numSizeClasses][]*slab
+
+	// slabs maps the address of each slab to it.
+	slabs map[uintptr]*slab
+}
+
+// A slab is slabSize bytes of memory carved into slots of one size.
+// Free slots form a list threaded through their first four bytes;
+// slots past carved have never been allocated.
+type slab struct {
+	mapping  []byte // the mapping mem was aligned within
+	mem      []byte
+	class    int
+	slotSize int
+	freeHead int32 // index of the first free slot, or -1
+	carved   int32
+	used     int
+
+	// partialIdx is the slab's index in its class's partial list, or
+	// -1 if it is full.
+	partialIdx int
+}
+
+// alloc returns n > 0 bytes of memory mapped outside the Go heap, to be
+// released with free.
+func (a *offHeapArena) alloc(n int) ([]byte, error) {
+	if n > maxSlotSize {
+		pages := syscall.Getpagesize()
+		b, err := mmap((n + pages - 1) / pages * pages)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	class := 0
+	if n > minSlotSize {
+		class = bits.Len(uint(n-1)) - bits.Len(minSlotSize-1)
+	}
+	if len(a.partial[class]) == 0 {
+		if err := a.newSlab(class); err != nil {
+			return nil, err
+		}
+	}
+	partial := a.partial[class]
+	s := partial[len(partial)-1]
+	idx := s.freeHead
+	if idx >= 0 {
+		s.freeHead = int32(binary.LittleEndian.Uint32(s.mem[int(idx)*s.slotSize:]))
+	} else {
+		idx = s.carved
+		s.carved++
+	}
+	s.used++
+	if s.freeHead < 0 && int(s.carved)*s.slotSize == slabSize {
+		a.partial[class] = partial[:len(partial)-1]
+		s.partialIdx = -1
+	}
+	off := int(idx) * s.slotSize
+	return s.mem[off : off+n : off+s.slotSize], nil
+}
+
+// free releases b, which was returned by alloc.
+func (a *offHeapArena) free(b []byte) {
+	if cap(b) > maxSlotSize {
+		syscall.Munmap(b[:cap(b)])
+		return
+	}
+	addr := uintptr(unsafe.Pointer(&b[:1][0]))
+	s := a.slabs[addr&^(slabSize-1)]
+	idx := int32(int(addr&(slabSize-1)) / s.slotSize)
+	binary.LittleEndian.PutUint32(s.mem[int(idx)*s.slotSize:], uint32(s.freeHead))
+	s.freeHead = idx
+	s.used--
+	if s.partialIdx < 0 {
+		s.partialIdx = len(a.partial[s.class])
+		a.partial[s.class] = append(a.partial[s.class], s)
+	}
+	if s.used == 0 && len(a.partial[s.class]) > 1 {
+		// Keep one empty slab per class, so that a value freed and
+		// allocated again doesn't map and unmap a slab each time.
+		a.dropSlab(s)
+	}
+}
+
+func (a *offHeapArena) newSlab(class int) error {
+	// Map twice the size to hold an aligned slab. The rest of the
+	// mapping is never touched, so it takes address space but no
+	// memory; syscall.Munmap can't trim it off.
+	m, err := mmap(2 * slabSize)
+	if err != nil {
+		return err
+	}
+	addr := uintptr(unsafe.Pointer(&m[0]))
+	head := int((slabSize - addr&(slabSize-1)) & (slabSize - 1))
+	s := &slab{
+		mapping:    m,
+		mem:        m[head : head+slabSize : head+slabSize],
+		class:      class,
+		slotSize:   minSlotSize << class,
+		freeHead:   -1,
+		partialIdx: len(a.partial[class]),
+	}
+	if a.slabs == nil {
+		a.slabs = make(map[uintptr]*slab)
+	}
+	a.slabs[addr+uintptr(head)] = s
+	a.partial[class] = append(a.partial[class], s)
+	return nil
+}
+
+// dropSlab unmaps the empty slab s.
+func (a *offHeapArena) dropSlab(s *slab) {
+	partial := a.partial[s.class]
+	last := partial[len(partial)-1]
+	partial[s.partialIdx] = last
+	last.partialIdx = s.partialIdx
+	a.partial[s.class] = partial[:len(partial)-1]
+	delete(a.slabs, uintptr(unsafe.Pointer(&s.mem[0])))
+	syscall.Munmap(s.mapping)
+}
+
+func mmap(n int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
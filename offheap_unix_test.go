@@ -0,0 +1,75 @@
+//go:build unix
+
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOffHeapArena(t *testing.T) {
+	var a offHeapArena
+	var bufs [][]byte
+	for i := 0; i < 10000; i++ {
+		b, err := a.alloc(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 100 || cap(b) != 128 {
+			t.Fatalf("alloc(100) has len %d, cap %d; want 100, 128", len(b), cap(b))
+		}
+		b[0], b[99] = byte(i), byte(i>>8)
+		bufs = append(bufs, b)
+	}
+	// 10000 128-byte slots fit in two 1 MiB slabs.
+	if n := len(a.slabs); n != 2 {
+		t.Errorf("%d slabs for 10000 small values; want 2", n)
+	}
+	for i, b := range bufs {
+		if b[0] != byte(i) || b[99] != byte(i>>8) {
+			t.Fatalf("value %d was overwritten", i)
+		}
+	}
+
+	big, err := a.alloc(100 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(big) != 100<<10 || cap(big)%4096 != 0 {
+		t.Errorf("large alloc has len %d, cap %d; want a page-rounded cap", len(big), cap(big))
+	}
+	a.free(big)
+
+	for _, b := range bufs {
+		a.free(b)
+	}
+	if n := len(a.slabs); n != 1 {
+		t.Errorf("%d slabs after freeing everything; want 1 kept", n)
+	}
+	// Freed slots are reused.
+	b, err := a.alloc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(b, bytes.Repeat([]byte{1}, 100))
+	if n := len(a.slabs); n != 1 {
+		t.Errorf("%d slabs after reallocating; want 1", n)
+	}
+}
+
+func TestOffHeapStorageChargesSlots(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat("x", 100))
+	}), WithOffHeapStorage())
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	st := s.CacheStats()
+	if want := int64(len("k") + 128); st.Bytes != want {
+		t.Errorf("Bytes = %d; want %d, the key and the value's slot", st.Bytes, want)
+	}
+	if st.OffHeapFallbacks != 0 {
+		t.Errorf("OffHeapFallbacks = %d; want 0", st.OffHeapFallbacks)
+	}
+}
@@ -0,0 +1,338 @@
+package cache
+
+import (
+	"hash/maphash"
+	"time"
+
+	"github.com/FeiniuBus/cache/singleflight"
+)
+
+// An Option configures a Store created with NewStore.
+type Option func(*Store)
+
+// WithCostFunc makes the store budget its cacheBytes against the cost
+// returned by fn rather than the length of each key and value. fn
+// must return the same cost for the same key and value every time it
+// is called.
+func WithCostFunc(fn func(key string, value ByteView) int64) Option {
+	return func(s *Store) {
+		s.cache.cost = fn
+	}
+}
+
+// WithPerEntryOverhead adds n bytes to the cost of each entry, so that
+// the cacheBytes budget also covers the memory the cache spends on
+// bookkeeping for each entry, which matters when entries are small.
+// The default is 0.
+func WithPerEntryOverhead(n int64) Option {
+	return func(s *Store) {
+		s.cache.overhead = n
+	}
+}
+
+// WithSecondaryStore makes the store consult secondary on a cache miss
+// before invoking its getter, and write loaded values through to it.
+// Errors from secondary are counted in Stats.SecondaryErrs and
+// otherwise ignored.
+func WithSecondaryStore(secondary SecondaryStore) Option {
+	return func(s *Store) {
+		s.secondary = secondary
+	}
+}
+
+// WithDistributedLocker coordinates loads with other processes that
+// share the store's secondary store. Before calling its getter for a
+// key, the store takes the key's lock from locker; if another process
+// holds it, the store polls the secondary store for the value that
+// process is loading, and loads the key itself only once wait passes.
+// It has no effect without WithSecondaryStore.
+func WithDistributedLocker(locker DistributedLocker, wait time.Duration) Option {
+	return func(s *Store) {
+		s.locker = locker
+		s.lockWait = wait
+	}
+}
+
+// WithOffHeapStorage makes the store keep cached values in memory
+// mapped outside the Go heap, so that they add no work for the garbage
+// collector. Values of up to 64 KiB are packed into shared 1 MiB
+// mappings in slots of the next power-of-two size, and larger values
+// get a mapping each, rounded up to whole pages; the memory each value
+// takes is charged to the cache's size. A value for which memory can't
+// be mapped is kept on the heap and counted in
+// CacheStats.OffHeapFallbacks. Values are copied onto the heap when
+// served from the cache. On platforms without mmap, values are kept on
+// the heap as usual.
+func WithOffHeapStorage() Option {
+	return func(s *Store) {
+		s.cache.offHeap = offHeapSupported
+	}
+}
+
+// WithShards splits the store's cache into n shards, each with its own
+// lock and an equal part of the store's cacheBytes, so that concurrent
+// operations on different keys don't contend. Eviction is LRU within
+// each shard rather than across the whole store.
+func WithShards(n int) Option {
+	return func(s *Store) {
+		s.cache.nshards = n
+	}
+}
+
+// WithMaxPinnedBytes caps the total cost of the values pinned by
+// Store.Pin at n. The default is half of the store's cacheBytes. With
+// WithShards, each shard may pin an equal part of n.
+func WithMaxPinnedBytes(n int64) Option {
+	return func(s *Store) {
+		s.cache.maxPinned = n
+	}
+}
+
+// WithShardHasher makes a store created WithShards pick the shard of
+// each key by hasher's hash of it, modulo the number of shards, instead
+// of by its 64-bit FNV-1a hash, for example to spread keys sharing long
+// prefixes more evenly. With WithKeyHashing, hasher is given the hashed
+// keys.
+func WithShardHasher(hasher func(key string) uint64) Option {
+	return func(s *Store) {
+		s.cache.hasher = hasher
+	}
+}
+
+// WithEvictionPolicy sets the policy the store uses to choose which
+// entries to evict when its cache is full. The default is PolicyLRU.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(s *Store) {
+		s.cache.policy = p
+	}
+}
+
+// WithDecayInterval makes a store using PolicyLFU halve the access
+// counts of its entries every d. By default counts never decay.
+func WithDecayInterval(d time.Duration) Option {
+	return func(s *Store) {
+		s.cache.decay = d
+	}
+}
+
+// WithSlidingTTL makes values cached by the store expire once they
+// have gone d without a hit, as for session data: each value expires d
+// after it is added, and every hit pushes its expiry back to d from
+// then. Values given an absolute expiry with SetExpiry, or a new one
+// with Touch, keep it and stop sliding. Hits update the expiry
+// atomically and, under PolicyClock, still take only a shared lock.
+func WithSlidingTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.cache.sliding = d
+	}
+}
+
+// WithBackend makes the store hold its entries in backends created by
+// fn, one per shard, instead of those of its eviction policy. The
+// backend must call onEvicted for every entry it removes, whether by
+// Remove, RemoveOldest or Clear, so that the store can account for it.
+func WithBackend(fn func(onEvicted func(key string, value interface{})) Backend) Option {
+	return func(s *Store) {
+		s.cache.newBackend = fn
+	}
+}
+
+// WithKeyHashing makes the store key its cache by a 128-bit hash of
+// each key instead of the key itself, so that long keys cost 16 bytes
+// each. The hash is made of hasher's 64-bit hash and an independent
+// 64-bit hash/maphash with a random per-store seed; keys collide, and
+// would share a cached value, only if both hashes collide, which for a
+// good hasher has a negligible probability. As the original keys are
+// not kept, keys passed to a cost function are the hashes, RemovePrefix
+// removes nothing and evictions are not reported to subscribers. If
+// hasher is nil, 64-bit FNV-1a is used.
+func WithKeyHashing(hasher func(key string) uint64) Option {
+	return func(s *Store) {
+		if hasher == nil {
+			hasher = fnv64a
+		}
+		s.keyHasher = hasher
+		s.keySeed = maphash.MakeSeed()
+	}
+}
+
+// WithKeyNormalizer makes the store pass every key through fn before
+// using it, so that equivalent keys such as "/a" and "/A/" share one
+// cached value. Keys are normalized by Get and its variants, Set,
+// SetWithMeta, GetOrSet, Update, Remove, RemoveAll, Peek, EntryInfo,
+// Touch, Pin and Unpin, and the getter, the secondary store and
+// subscribers see normalized keys. RemovePrefix matches its prefix
+// against normalized keys as given. Each key is normalized once per
+// call. fn cannot fail: it must return a key for every input, and must
+// be safe for concurrent use.
+func WithKeyNormalizer(fn func(key string) string) Option {
+	return func(s *Store) {
+		s.normalize = fn
+	}
+}
+
+// WithHotKeyTracking makes the store track the keys whose loads are
+// most often shared by concurrent callers, for HotKeys. At most size
+// keys are tracked, so the counts are estimates once more distinct keys
+// than that have been seen.
+func WithHotKeyTracking(size int) Option {
+	return func(s *Store) {
+		if size > 0 {
+			s.hotKeys = newHotKeys(size)
+		}
+	}
+}
+
+// WithValidator makes the store check each value loaded by its getter,
+// or found in its secondary store, with fn before caching it. If fn
+// returns an error, the value is not cached and Get fails with the
+// error; to serve the value without caching it, return an error made
+// with DontCache instead. Values from the secondary store that fail
+// validation are treated as misses.
+func WithValidator(fn func(key string, value ByteView) error) Option {
+	return func(s *Store) {
+		s.validator = fn
+	}
+}
+
+// WithMaxInFlight caps the number of distinct keys the store loads at
+// once at n. While n loads are in flight, Get fails fast with
+// ErrTooBusy for keys that are neither cached nor being loaded, which
+// bounds the memory a flood of unique keys can hold. Gets for a key
+// already being loaded still wait for it. A non-positive n means no
+// limit.
+func WithMaxInFlight(n int) Option {
+	return func(s *Store) {
+		if sf, ok := s.loadStore.(*singleflight.Store); ok {
+			sf.MaxInFlight = n
+		}
+	}
+}
+
+// WithFlightStore makes the store suppress duplicate loads through fs,
+// which may be shared with other stores so that they load each key
+// once between them. A Get that joins a load run by another store
+// receives, and caches, the value loaded by that store's getter under
+// that store's options; the stores sharing fs should therefore map
+// each key to the same value, such as by loading from a common backend.
+// Stores whose keys mean different things must not share a flight
+// store, or must prefix their keys to keep them apart. Apply
+// WithMaxInFlight after WithFlightStore to set fs's limit, which then
+// applies to the loads of all the stores sharing it, as do
+// PendingLoads and FlightStats.
+func WithFlightStore(fs *singleflight.Store) Option {
+	return func(s *Store) {
+		s.loadStore = fs
+	}
+}
+
+// WithSingleflight(false) makes the store call its getter for every
+// Get that misses the cache, without suppressing concurrent loads of
+// the same key. This saves the cost of suppression for a store whose
+// getter is cheap and idempotent; Stats.LoadsDeduped stays zero, and
+// WithMaxInFlight has no effect. WithSingleflight(true) restores a
+// store's own flight store.
+func WithSingleflight(enabled bool) Option {
+	return func(s *Store) {
+		_, direct := s.loadStore.(directFlight)
+		switch {
+		case !enabled:
+			s.loadStore = directFlight{}
+		case direct:
+			s.loadStore = &singleflight.Store{}
+		}
+	}
+}
+
+// WithKeyRateLimit makes the store call its getter at most n times per
+// key in each window, bounding the loads of a key whose values are
+// never cached, such as one failing validation. Further Gets for the
+// key in the window fail with the error of the getter's last call for
+// it, or with ErrRateLimited if that call succeeded. Windows are
+// shared by all keys. Duplicate suppression already keeps concurrent
+// Gets of a key to one call; this limits calls in sequence.
+func WithKeyRateLimit(n int, window time.Duration) Option {
+	return func(s *Store) {
+		if n > 0 && window > 0 {
+			s.limiter = newKeyLimiter(n, window)
+		}
+	}
+}
+
+// WithAdmissionPolicy makes the store ask admit before caching each
+// value, whether loaded or Set. current and limit are the bytes in use
+// and the budget of the shard the value would go to. If admit returns
+// false, the value is served but not cached, and any value cached for
+// the key is removed.
+func WithAdmissionPolicy(admit func(key string, value ByteView, current, limit int64) bool) Option {
+	return func(s *Store) {
+		s.admit = admit
+	}
+}
+
+// WithAdmission sets the policy the store uses to decide whether to
+// cache a value, whether loaded or Set, when caching it would evict
+// another. The default is AdmitAll. A rejected value is served but not
+// cached, and any value cached for the key is removed.
+func WithAdmission(p AdmissionPolicy) Option {
+	return func(s *Store) {
+		s.lfu = nil
+		if p == PolicyTinyLFU && s.cacheBytes > 0 {
+			// Size the sketch for entries of about 128 bytes;
+			// newTinyLFU caps it.
+			n := s.cacheBytes / 128
+			if n > 1<<24 {
+				n = 1 << 24
+			}
+			s.lfu = newTinyLFU(int(n))
+		}
+	}
+}
+
+// WithOnLoadError makes the store call fn with the key and error of
+// each load that fails, as counted by Stats.LocalLoadErrs. fn is called
+// once per failed getter call, not once per waiting Get, and while no
+// store locks are held, but before the waiting Gets return.
+func WithOnLoadError(fn func(key string, err error)) Option {
+	return func(s *Store) {
+		s.onLoadError = fn
+	}
+}
+
+// WithHighWatermark makes the store call cb with its CacheStats when a
+// value added to its cache takes it past fraction of its cacheBytes, as
+// an early warning before it fills up. cb is called once per crossing:
+// not again until the cache has dropped back to fraction or below. It
+// is called by the goroutine that added the value, holding no locks.
+func WithHighWatermark(fraction float64, cb func(stats CacheStats)) Option {
+	return func(s *Store) {
+		s.watermark = fraction
+		s.onWatermark = cb
+	}
+}
+
+// WithOnEvict makes the store call fn with the key, value and reason of
+// every entry that leaves its cache, other than by being replaced with
+// a new value for its key, for example to write evicted values back to
+// a slower tier. fn is called synchronously, outside of the store's
+// locks. With key hashing fn is never called, as the original keys are
+// not kept.
+func WithOnEvict(fn func(key string, value ByteView, reason EvictReason)) Option {
+	return func(s *Store) {
+		s.onEvict = fn
+		s.cache.keepEvicted = fn != nil
+	}
+}
+
+// WithLogger makes the store log diagnostics to l: errors from its
+// secondary store, panics of loads that concurrent Gets were waiting
+// on, and the loads forgotten by SweepLoads. By default nothing is
+// logged.
+func WithLogger(l Logger) Option {
+	return func(s *Store) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		s.logger = l
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by Get on a store created WithKeyRateLimit
+// when the getter was already called for the key as often as allowed in
+// the current window and its last call did not fail.
+var ErrRateLimited = errors.New("cache: getter rate limited for key")
+
+// keyLimiter caps the getter calls per key in fixed windows shared by
+// all keys. The counts are dropped when a window ends, so its memory is
+// bounded by the keys loaded in one window.
+type keyLimiter struct {
+	n      int
+	window time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	keys  map[string]*keyLimit
+}
+
+type keyLimit struct {
+	calls   int
+	lastErr error
+}
+
+func newKeyLimiter(n int, window time.Duration) *keyLimiter {
+	return &keyLimiter{n: n, window: window}
+}
+
+// allow reports whether the getter may be called for key, counting the
+// call if so. Otherwise it returns the error to fail the load with.
+func (kl *keyLimiter) allow(key string) error {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if now := time.Now(); kl.keys == nil || now.Sub(kl.start) >= kl.window {
+		kl.start = now
+		kl.keys = make(map[string]*keyLimit)
+	}
+	l := kl.keys[key]
+	if l == nil {
+		l = new(keyLimit)
+		kl.keys[key] = l
+	}
+	if l.calls >= kl.n {
+		if l.lastErr != nil {
+			return l.lastErr
+		}
+		return ErrRateLimited
+	}
+	l.calls++
+	return nil
+}
+
+// done records the result of a getter call allowed for key. A value
+// served without being cached is not a failure.
+func (kl *keyLimiter) done(key string, err error) {
+	var dc *dontCacheError
+	if errors.As(err, &dc) {
+		err = nil
+	}
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if l := kl.keys[key]; l != nil {
+		l.lastErr = err
+	}
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// shardedCache spreads keys over one or more caches, each with its own
+// lock, so that operations on keys in different shards don't contend.
+// Each shard is budgeted an equal part of the store's cacheBytes.
+type shardedCache struct {
+	// gen is the cache's generation, shared by all shards. It is
+	// first so that it is 8-byte aligned for atomic access.
+	gen int64
+
+	// nshards, cost, overhead, offHeap, policy, decay, sliding,
+	// newBackend and keepEvicted are set by options and copied into
+	// each shard by init, which gives each shard an equal part of
+	// maxPinned.
+	nshards     int
+	cost        func(key string, value ByteView) int64
+	overhead    int64
+	offHeap     bool
+	policy      EvictionPolicy
+	decay       time.Duration
+	sliding     time.Duration
+	newBackend  func(onEvicted func(key string, value interface{})) Backend
+	maxPinned   int64
+	keepEvicted bool
+
+	// hasher, if set, picks the shard of each key in place of fnv64a.
+	hasher func(key string) uint64
+
+	shards []*cache
+}
+
+func (sc *shardedCache) init() {
+	if sc.nshards < 1 {
+		sc.nshards = 1
+	}
+	sc.shards = make([]*cache, sc.nshards)
+	for i := range sc.shards {
+		sc.shards[i] = &cache{
+			cost:        sc.cost,
+			overhead:    sc.overhead,
+			offHeap:     sc.offHeap,
+			policy:      sc.policy,
+			decay:       sc.decay,
+			sliding:     sc.sliding,
+			newBackend:  sc.newBackend,
+			maxPinned:   sc.maxPinned / int64(sc.nshards),
+			keepEvicted: sc.keepEvicted,
+			gen:         &sc.gen,
+		}
+	}
+}
+
+// shard returns the cache holding key.
+func (sc *shardedCache) shard(key string) *cache {
+	if len(sc.shards) == 1 {
+		return sc.shards[0]
+	}
+	var h uint64
+	if sc.hasher != nil {
+		h = sc.hasher(key)
+	} else {
+		h = fnv64a(key)
+	}
+	return sc.shards[h%uint64(len(sc.shards))]
+}
+
+// limit returns the byte budget of each shard.
+func (sc *shardedCache) limit(cacheBytes int64) int64 {
+	return cacheBytes / int64(len(sc.shards))
+}
+
+// generation returns the current generation.
+func (sc *shardedCache) generation() int64 {
+	return atomic.LoadInt64(&sc.gen)
+}
+
+// invalidate starts a new generation, making all existing entries
+// stale.
+func (sc *shardedCache) invalidate() {
+	atomic.AddInt64(&sc.gen, 1)
+}
+
+func (sc *shardedCache) get(key string, maxAge time.Duration) (ByteView, map[string]string, bool) {
+	return sc.shard(key).get(key, maxAge)
+}
+
+func (sc *shardedCache) peek(key string) (ByteView, bool) {
+	return sc.shard(key).peek(key)
+}
+
+func (sc *shardedCache) info(key string) (EntryInfo, bool) {
+	return sc.shard(key).info(key)
+}
+
+func (sc *shardedCache) pin(key string) bool {
+	return sc.shard(key).pin(key)
+}
+
+func (sc *shardedCache) unpin(key string) bool {
+	return sc.shard(key).unpin(key)
+}
+
+func (sc *shardedCache) touch(key string, ttl time.Duration) bool {
+	return sc.shard(key).touch(key, ttl)
+}
+
+func (sc *shardedCache) remove(key string) []eviction {
+	return sc.shard(key).remove(key)
+}
+
+func (sc *shardedCache) keys(prefix string) []string {
+	var keys []string
+	for _, c := range sc.shards {
+		keys = append(keys, c.keys(prefix)...)
+	}
+	return keys
+}
+
+func (sc *shardedCache) each(fn func(key string, e savedEntry) error) error {
+	for _, c := range sc.shards {
+		if err := c.each(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *shardedCache) removePrefix(prefix string) []eviction {
+	var evs []eviction
+	for _, c := range sc.shards {
+		evs = append(evs, c.removePrefix(prefix)...)
+	}
+	return evs
+}
+
+func (sc *shardedCache) clear() []eviction {
+	var evs []eviction
+	for _, c := range sc.shards {
+		evs = append(evs, c.clear()...)
+	}
+	return evs
+}
+
+func (sc *shardedCache) removeKeys(keys []string) []eviction {
+	if len(sc.shards) == 1 {
+		return sc.shards[0].removeKeys(keys)
+	}
+	byShard := make(map[*cache][]string)
+	for _, key := range keys {
+		c := sc.shard(key)
+		byShard[c] = append(byShard[c], key)
+	}
+	var evs []eviction
+	for c, keys := range byShard {
+		evs = append(evs, c.removeKeys(keys)...)
+	}
+	return evs
+}
+
+func (sc *shardedCache) bytes() int64 {
+	var n int64
+	for _, c := range sc.shards {
+		n += c.bytes()
+	}
+	return n
+}
+
+func (sc *shardedCache) stats() CacheStats {
+	var st CacheStats
+	for _, c := range sc.shards {
+		cs := c.stats()
+		st.Bytes += cs.Bytes
+		st.Items += cs.Items
+		st.Gets += cs.Gets
+		st.Hits += cs.Hits
+		st.Evictions += cs.Evictions
+		st.OffHeapFallbacks += cs.OffHeapFallbacks
+	}
+	return st
+}
+
+func (sc *shardedCache) expired() int64 {
+	var n int64
+	for _, c := range sc.shards {
+		n += c.expired()
+	}
+	return n
+}
+
+func (sc *shardedCache) resetStats() {
+	for _, c := range sc.shards {
+		c.resetStats()
+	}
+}
+
+func (sc *shardedCache) sizeStats() SizeStats {
+	var st SizeStats
+	var nvalbytes, items int64
+	added := false
+	for _, c := range sc.shards {
+		c.mu.RLock()
+		if c.nadded > 0 {
+			if !added || c.minval < st.MinValueBytes {
+				st.MinValueBytes = c.minval
+			}
+			if c.maxval > st.MaxValueBytes {
+				st.MaxValueBytes = c.maxval
+			}
+			added = true
+		}
+		nvalbytes += c.nvalbytes
+		items += c.itemsLocked()
+		c.mu.RUnlock()
+	}
+	if items > 0 {
+		st.AvgValueBytes = nvalbytes / items
+	}
+	return st
+}
+
+// fnv64a returns the 64-bit FNV-1a hash of s.
+func fnv64a(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
@@ -0,0 +1,91 @@
+package singleflight
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Group is a typed wrapper around Store for results of type T.
+// The zero value is ready to use.
+type Group[T any] struct {
+	s Store
+}
+
+// Do executes and returns the results of the given function, making
+// sure that only one execution is in-flight for a given key at a
+// time. If a duplicate comes in, the duplicate caller waits for the
+// original to complete and receives the same results. The return
+// value shared reports whether v was given to multiple callers.
+func (g *Group[T]) Do(key string, fn func() (T, error)) (T, error, bool) {
+	vi, err, shared := g.s.do(key, 0, func() (interface{}, error) {
+		return fn()
+	})
+	return typed[T](vi), err, shared
+}
+
+// KeyedGroup is like Group, but keyed by values of any comparable
+// type, such as structs, which are compared as map keys rather than
+// through a string form that different keys might share. The zero
+// value is ready to use.
+type KeyedGroup[K comparable, T any] struct {
+	mu sync.Mutex
+	m  map[K]*call
+}
+
+// Do is like Group.Do, with key of type K.
+func (g *KeyedGroup[K, T]) Do(key K, fn func() (T, error)) (v T, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[K]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return typed[T](c.val), c.err, true
+	}
+	c := &call{started: time.Now()}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	returned := false
+	defer func() {
+		if returned {
+			return
+		}
+		// As in Store.do, fail the waiting callers and forget the
+		// call rather than leave the key wedged, and let the panic
+		// continue in this one.
+		r := recover()
+		if r != nil {
+			c.err = fmt.Errorf("%w: %v", ErrPanicked, r)
+		} else {
+			c.err = errGoexit
+		}
+		c.wg.Done()
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		if r != nil {
+			panic(r)
+		}
+	}()
+	c.val, c.err = fn()
+	returned = true
+	c.wg.Done()
+
+	g.mu.Lock()
+	shared = c.dups > 0
+	delete(g.m, key)
+	g.mu.Unlock()
+
+	return typed[T](c.val), c.err, shared
+}
+
+// typed returns vi as a T, or the zero T if vi is nil.
+func typed[T any](vi interface{}) T {
+	v, _ := vi.(T)
+	return v
+}
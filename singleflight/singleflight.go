@@ -1,45 +1,269 @@
 package singleflight
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrTooBusy is returned by a Store with MaxInFlight set when a call
+// for a new key would exceed it.
+var ErrTooBusy = errors.New("singleflight: too many calls in flight")
+
+// ErrPanicked is wrapped by the error returned to callers waiting on a
+// call whose fn panicked. The caller that executed fn panics as well.
+var ErrPanicked = errors.New("singleflight: fn panicked")
+
+// errGoexit is returned to callers waiting on a call whose fn called
+// runtime.Goexit.
+var errGoexit = errors.New("singleflight: fn called runtime.Goexit")
+
 // call is an in-flight or completed Do call
 type call struct {
 	wg  sync.WaitGroup
 	val interface{}
 	err error
+
+	// dups counts the callers that waited on this call. It is
+	// guarded by the mutex of the map holding the call.
+	dups int
+
+	// holdsSlot is whether the call counts toward inFlight. It is
+	// cleared, under the same mutex, by whichever of finish and Sweep
+	// releases the slot first.
+	holdsSlot bool
+
+	started time.Time
+}
+
+// numShards is the number of shards a Store's calls are spread over
+// by key, so that calls for unrelated keys rarely contend on a lock.
+const numShards = 32
+
+// shard holds the calls for the keys hashing to it.
+type shard struct {
+	mu sync.Mutex
+	m  map[string]*call
+
+	// Pad shards to separate cache lines, so that locking one doesn't
+	// slow down its neighbours.
+	_ [48]byte
 }
 
 // Store represents a class of work and forms a namespace in which
 // units of work can be executed with duplicate suppression.
 type Store struct {
-	mu sync.Mutex
-	m  map[string]*call
+	// inFlight, calls, deduped and panics are accessed atomically.
+	// They are first so that they are 8-byte aligned on 32-bit
+	// platforms.
+	inFlight int64
+	calls    int64
+	deduped  int64
+	panics   int64
+
+	// MaxInFlight, if positive, caps the number of distinct keys with
+	// a call in flight. Calls for other keys fail with ErrTooBusy
+	// without executing fn; calls joining one in flight are admitted.
+	MaxInFlight int
+
+	shards [numShards]shard
+}
+
+// Stats are counts of a Store's calls since it was created.
+type Stats struct {
+	// Calls is the number of calls to Do and DoCached.
+	Calls int64
+
+	// Deduped is the number of calls that received the results of
+	// another call rather than executing fn.
+	Deduped int64
+
+	// Panics is the number of calls whose fn panicked.
+	Panics int64
+}
+
+// Stats returns the Store's counts. Deduped divided by Calls is the
+// share of calls whose work was suppressed as duplicate.
+func (s *Store) Stats() Stats {
+	return Stats{
+		Calls:   atomic.LoadInt64(&s.calls),
+		Deduped: atomic.LoadInt64(&s.deduped),
+		Panics:  atomic.LoadInt64(&s.panics),
+	}
+}
+
+// shard returns the shard holding the calls for key.
+func (s *Store) shard(key string) *shard {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per call.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h%numShards]
 }
 
 // Do executes and returns the results of the given function.
 func (s *Store) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
-	s.mu.Lock()
-	if s.m == nil {
-		s.m = make(map[string]*call)
+	return s.DoCached(key, 0, fn)
+}
+
+// DoCached is like Do, but keeps the completed call for ttl after fn
+// returns, so callers arriving within ttl get the same results
+// without executing fn again. A ttl <= 0 behaves like Do.
+func (s *Store) DoCached(key string, ttl time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	v, err, _ := s.do(key, ttl, fn)
+	return v, err
+}
+
+// do is DoCached that also reports whether the results were given to
+// more than one caller.
+func (s *Store) do(key string, ttl time.Duration, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	if sh.m == nil {
+		sh.m = make(map[string]*call)
 	}
-	if c, ok := s.m[key]; ok {
-		s.mu.Unlock()
+	atomic.AddInt64(&s.calls, 1)
+	if c, ok := sh.m[key]; ok {
+		c.dups++
+		sh.mu.Unlock()
+		atomic.AddInt64(&s.deduped, 1)
 		c.wg.Wait()
-		return c.val, c.err
+		return c.val, c.err, true
+	}
+	// inFlight is shared by all shards, so it is only counted when
+	// there is a cap to enforce.
+	limited := s.MaxInFlight > 0
+	if limited && atomic.AddInt64(&s.inFlight, 1) > int64(s.MaxInFlight) {
+		atomic.AddInt64(&s.inFlight, -1)
+		sh.mu.Unlock()
+		return nil, ErrTooBusy, false
 	}
-	c := new(call)
+	c := &call{started: time.Now(), holdsSlot: limited}
 	c.wg.Add(1)
-	s.m[key] = c
-	s.mu.Unlock()
+	sh.m[key] = c
+	sh.mu.Unlock()
 
+	returned := false
+	defer func() {
+		if returned {
+			return
+		}
+		// fn panicked or called runtime.Goexit. Fail the waiting
+		// callers rather than leave them blocked, and let the panic
+		// continue in this one.
+		r := recover()
+		if r != nil {
+			atomic.AddInt64(&s.panics, 1)
+			c.err = fmt.Errorf("%w: %v", ErrPanicked, r)
+		} else {
+			c.err = errGoexit
+		}
+		c.wg.Done()
+		s.finish(sh, key, c, 0)
+		if r != nil {
+			panic(r)
+		}
+	}()
 	c.val, c.err = fn()
+	returned = true
 	c.wg.Done()
 
-	s.mu.Lock()
-	delete(s.m, key)
-	s.mu.Unlock()
+	shared = s.finish(sh, key, c, ttl)
+	return c.val, c.err, shared
+}
+
+// finish does the bookkeeping for the call c for key in sh once fn has
+// returned, and reports whether its results were shared.
+func (s *Store) finish(sh *shard, key string, c *call, ttl time.Duration) (shared bool) {
+	// The call can only be forgotten once fn has returned, so this
+	// second acquisition can't be folded into the first; it does all
+	// the bookkeeping for the finished call in one critical section.
+	// BenchmarkDo measures it: contention between unrelated keys, not
+	// the extra acquisition, dominates under parallel load, which is
+	// why calls are sharded.
+	sh.mu.Lock()
+	s.releaseSlotLocked(c)
+	shared = c.dups > 0
+	if ttl <= 0 {
+		sh.forgetLocked(key, c)
+	}
+	sh.mu.Unlock()
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() {
+			sh.mu.Lock()
+			sh.forgetLocked(key, c)
+			sh.mu.Unlock()
+		})
+	}
+	return shared
+}
+
+// releaseSlotLocked gives back the inFlight slot c holds, if any. The
+// mutex of the shard holding c must be held.
+func (s *Store) releaseSlotLocked(c *call) {
+	if c.holdsSlot {
+		c.holdsSlot = false
+		atomic.AddInt64(&s.inFlight, -1)
+	}
+}
+
+// forgetLocked removes c from the map if it is still the call for key.
+func (sh *shard) forgetLocked(key string, c *call) {
+	if sh.m[key] == c {
+		delete(sh.m, key)
+	}
+}
+
+// Pending returns the number of calls currently held, whether in
+// flight or completed and kept by DoCached.
+func (s *Store) Pending() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.m)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Waiters returns the number of callers waiting on the call held for
+// key besides the one executing it. Tests can wait for it to reach the
+// number of duplicate callers they started before letting fn return,
+// rather than sleeping.
+func (s *Store) Waiters(key string) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if c, ok := sh.m[key]; ok {
+		return c.dups
+	}
+	return 0
+}
 
-	return c.val, c.err
+// Sweep forgets calls started more than maxAge ago, so that later
+// callers for their keys execute a new call instead of waiting on one
+// that may never return. A forgotten call gives back its slot under
+// MaxInFlight. Callers already waiting on a forgotten call keep
+// waiting for it. Sweep returns the number of calls forgotten.
+func (s *Store) Sweep(maxAge time.Duration) int {
+	deadline := time.Now().Add(-maxAge)
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for key, c := range sh.m {
+			if c.started.Before(deadline) {
+				delete(sh.m, key)
+				s.releaseSlotLocked(c)
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return n
 }
@@ -3,6 +3,7 @@ package singleflight
 import (
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -60,10 +61,386 @@ func TestDoDupSuppress(t *testing.T) {
 			wg.Done()
 		}()
 	}
-	time.Sleep(100 * time.Millisecond)
+	for s.Waiters("key") < n-1 {
+		runtime.Gosched()
+	}
 	c <- "bar"
 	wg.Wait()
 	if got := atomic.LoadInt32(&calls); got != 1 {
 		t.Errorf("number of calls = %d; want 1", got)
 	}
 }
+
+func TestDoCached(t *testing.T) {
+	var s Store
+	var calls int32
+	fn := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		v, err := s.DoCached("key", time.Hour, fn)
+		if err != nil {
+			t.Fatalf("DoCached error = %v", err)
+		}
+		if v.(int32) != 1 {
+			t.Errorf("DoCached #%d = %v; want 1", i+1, v)
+		}
+	}
+
+	s.DoCached("short", time.Millisecond, fn)
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := s.DoCached("short", time.Millisecond, fn); v.(int32) != 3 {
+		t.Errorf("DoCached after ttl = %v; want 3", v)
+	}
+}
+
+func TestGroupDo(t *testing.T) {
+	var g Group[int]
+	c := make(chan int)
+	var calls int32
+	fn := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-c, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var nshared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, shared := g.Do("key", fn)
+			if err != nil {
+				t.Errorf("Do error: %v", err)
+			}
+			if v != 42 {
+				t.Errorf("got %d; want 42", v)
+			}
+			if shared {
+				atomic.AddInt32(&nshared, 1)
+			}
+		}()
+	}
+	for g.s.Waiters("key") < n-1 {
+		runtime.Gosched()
+	}
+	c <- 42
+	wg.Wait()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("number of calls = %d; want 1", got)
+	}
+	if got := atomic.LoadInt32(&nshared); got != n {
+		t.Errorf("shared results = %d; want %d", got, n)
+	}
+}
+
+func TestGroupDoErr(t *testing.T) {
+	var g Group[*int]
+	someErr := errors.New("Some error")
+	v, err, shared := g.Do("key", func() (*int, error) {
+		return nil, someErr
+	})
+	if err != someErr {
+		t.Errorf("Do error = %v; want someErr", err)
+	}
+	if v != nil || shared {
+		t.Errorf("Do = %v, shared %v; want nil, false", v, shared)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	var s Store
+	hung := make(chan struct{})
+	defer close(hung)
+	go s.Do("hung", func() (interface{}, error) {
+		<-hung
+		return nil, nil
+	})
+	for s.Pending() == 0 {
+		runtime.Gosched()
+	}
+	waiting := make(chan struct{})
+	go func() {
+		s.Do("hung", func() (interface{}, error) { return nil, nil })
+		close(waiting)
+	}()
+	for s.Waiters("hung") < 1 {
+		runtime.Gosched()
+	}
+
+	if got := s.Sweep(time.Hour); got != 0 {
+		t.Errorf("Sweep(time.Hour) = %d; want 0", got)
+	}
+	// The call is forgotten once it is older than maxAge.
+	swept := 0
+	for swept == 0 {
+		swept = s.Sweep(time.Millisecond)
+		runtime.Gosched()
+	}
+	if swept != 1 || s.Pending() != 0 {
+		t.Errorf("Sweep = %d, leaving %d pending; want 1, 0", swept, s.Pending())
+	}
+	select {
+	case <-waiting:
+		t.Error("waiter on a swept call returned before the call did")
+	default:
+	}
+
+	v, err := s.Do("hung", func() (interface{}, error) {
+		return "fresh", nil
+	})
+	if v != "fresh" || err != nil {
+		t.Errorf("Do after Sweep = %v, %v; want fresh, nil", v, err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s := Store{MaxInFlight: 1}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Do("a", func() (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		close(done)
+	}()
+	<-started
+	called := false
+	_, err := s.Do("b", func() (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if err != ErrTooBusy || called {
+		t.Errorf("Do(b) = %v, called %v; want ErrTooBusy, not called", err, called)
+	}
+	close(release)
+	<-done
+	if _, err := s.Do("b", func() (interface{}, error) { return nil, nil }); err != nil {
+		t.Errorf("Do(b) after a finished = %v; want nil", err)
+	}
+}
+
+func TestSweepReleasesInFlightSlot(t *testing.T) {
+	s := Store{MaxInFlight: 1}
+	hung := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Do("hung", func() (interface{}, error) {
+			<-hung
+			return nil, nil
+		})
+		close(done)
+	}()
+	for s.Pending() == 0 {
+		runtime.Gosched()
+	}
+	for s.Sweep(time.Millisecond) == 0 {
+		runtime.Gosched()
+	}
+	if _, err := s.Do("b", func() (interface{}, error) { return nil, nil }); err != nil {
+		t.Errorf("Do(b) after sweeping the hung call = %v; want nil", err)
+	}
+
+	// The hung call returning doesn't give back its slot a second time.
+	close(hung)
+	<-done
+	if n := atomic.LoadInt64(&s.inFlight); n != 0 {
+		t.Errorf("inFlight = %d after all calls returned; want 0", n)
+	}
+}
+
+func TestKeyedGroupDo(t *testing.T) {
+	type key struct {
+		A, B string
+	}
+	var g KeyedGroup[key, string]
+	release := make(chan struct{})
+	var calls int32
+	fn := func(k key) func() (string, error) {
+		return func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return k.A + "|" + k.B, nil
+		}
+	}
+
+	// Keys whose naive concatenations collide are still distinct.
+	keys := []key{{"a", "bc"}, {"ab", "c"}, {"a", "bc"}}
+	var wg sync.WaitGroup
+	results := make([]string, len(keys))
+	for i, k := range keys {
+		wg.Add(1)
+		go func(i int, k key) {
+			defer wg.Done()
+			v, err, _ := g.Do(k, fn(k))
+			if err != nil {
+				t.Errorf("Do error: %v", err)
+			}
+			results[i] = v
+		}(i, k)
+	}
+	for {
+		g.mu.Lock()
+		n := len(g.m)
+		dups := 0
+		if c := g.m[keys[0]]; c != nil {
+			dups = c.dups
+		}
+		g.mu.Unlock()
+		if n == 2 && dups == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("number of calls = %d; want 2", got)
+	}
+	if want := []string{"a|bc", "ab|c", "a|bc"}; fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Errorf("results = %v; want %v", results, want)
+	}
+}
+
+func BenchmarkDo(b *testing.B) {
+	fn := func() (interface{}, error) { return nil, nil }
+	b.Run("HotKey", func(b *testing.B) {
+		var s Store
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s.Do("key", fn)
+			}
+		})
+	})
+	b.Run("DistinctKeys", func(b *testing.B) {
+		var s Store
+		var next int64
+		b.RunParallel(func(pb *testing.PB) {
+			key := fmt.Sprint(atomic.AddInt64(&next, 1))
+			for pb.Next() {
+				s.Do(key, fn)
+			}
+		})
+	})
+}
+
+func TestStats(t *testing.T) {
+	var s Store
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Do("key", func() (interface{}, error) {
+			<-release
+			return nil, nil
+		})
+		close(done)
+	}()
+	for s.Pending() == 0 {
+		runtime.Gosched()
+	}
+	const dups = 3
+	var wg sync.WaitGroup
+	for i := 0; i < dups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Do("key", func() (interface{}, error) { return nil, nil })
+		}()
+	}
+	for s.Waiters("key") < dups {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	<-done
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v; want boom", r)
+			}
+		}()
+		s.Do("panic", func() (interface{}, error) { panic("boom") })
+	}()
+	if n := s.Pending(); n != 0 {
+		t.Errorf("Pending after panic = %d; want 0", n)
+	}
+
+	want := Stats{Calls: dups + 2, Deduped: dups, Panics: 1}
+	if got := s.Stats(); got != want {
+		t.Errorf("Stats = %+v; want %+v", got, want)
+	}
+}
+
+func TestDoPanicFailsWaiters(t *testing.T) {
+	var s Store
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		s.Do("key", func() (interface{}, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+	for s.Pending() == 0 {
+		runtime.Gosched()
+	}
+	errc := make(chan error)
+	go func() {
+		_, err := s.Do("key", func() (interface{}, error) { return nil, nil })
+		errc <- err
+	}()
+	for s.Waiters("key") < 1 {
+		runtime.Gosched()
+	}
+	close(release)
+	if err := <-errc; !errors.Is(err, ErrPanicked) {
+		t.Errorf("waiter got %v; want ErrPanicked", err)
+	}
+}
+
+func TestKeyedGroupDoPanic(t *testing.T) {
+	var g KeyedGroup[int, string]
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.Do(1, func() (string, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+	waiters := func() int {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if c, ok := g.m[1]; ok {
+			return c.dups
+		}
+		return -1
+	}
+	for waiters() < 0 {
+		runtime.Gosched()
+	}
+	errc := make(chan error)
+	go func() {
+		_, err, _ := g.Do(1, func() (string, error) { return "", nil })
+		errc <- err
+	}()
+	for waiters() < 1 {
+		runtime.Gosched()
+	}
+	close(release)
+	if err := <-errc; !errors.Is(err, ErrPanicked) {
+		t.Errorf("waiter got %v; want ErrPanicked", err)
+	}
+
+	// The key is not wedged: a later call runs its own function.
+	v, err, _ := g.Do(1, func() (string, error) { return "ok", nil })
+	if err != nil || v != "ok" {
+		t.Errorf("Do after panic = %q, %v; want ok", v, err)
+	}
+}
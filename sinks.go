@@ -1,7 +1,15 @@
 package cache
 
-import "errors"
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"sync"
+	"time"
+)
 
 // A Sink receives data from a Get call.
 type Sink interface {
@@ -41,13 +49,23 @@ type stringSink struct {
 	v  ByteView
 }
 
+var stringSinkPool = sync.Pool{
+	New: func() interface{} { return new(stringSink) },
+}
+
+// reset makes s populate sp, dropping any view it holds so that a
+// pooled sink doesn't keep a value alive.
+func (s *stringSink) reset(sp *string) {
+	s.sp = sp
+	s.v = ByteView{}
+}
+
 func (s *stringSink) view() (ByteView, error) {
 	return s.v, nil
 }
 
 func (s *stringSink) SetString(v string) error {
-	s.v.b = nil
-	s.v.s = v
+	s.v = NewStringView(v)
 	*s.sp = v
 	return nil
 }
@@ -57,7 +75,7 @@ func (s *stringSink) SetBytes(v []byte) error {
 }
 
 func (s *stringSink) SetJSON(m interface{}) error {
-	b, err := json.Marshal(m)
+	b, err := marshalJSON(m)
 	if err != nil {
 		return err
 	}
@@ -93,12 +111,12 @@ func (s *byteViewSink) SetBytes(b []byte) error {
 }
 
 func (s *byteViewSink) SetString(v string) error {
-	*s.dst = ByteView{s: v}
+	*s.dst = NewStringView(v)
 	return nil
 }
 
 func (s *byteViewSink) SetJSON(m interface{}) error {
-	b, err := json.Marshal(m)
+	b, err := marshalJSON(m)
 	if err != nil {
 		return err
 	}
@@ -118,6 +136,17 @@ type allocBytesSink struct {
 	v   ByteView
 }
 
+var allocBytesSinkPool = sync.Pool{
+	New: func() interface{} { return new(allocBytesSink) },
+}
+
+// reset makes s populate dst, dropping any view it holds so that a
+// pooled sink doesn't keep a value alive.
+func (s *allocBytesSink) reset(dst *[]byte) {
+	s.dst = dst
+	s.v = ByteView{}
+}
+
 func (s *allocBytesSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -151,19 +180,116 @@ func (s *allocBytesSink) SetString(v string) error {
 		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
 	}
 	*s.dst = []byte(v)
-	s.v.b = nil
-	s.v.s = v
+	s.v = NewStringView(v)
 	return nil
 }
 
 func (s *allocBytesSink) SetJSON(m interface{}) error {
-	b, err := json.Marshal(m)
+	b, err := marshalJSON(m)
 	if err != nil {
 		return err
 	}
 	return s.setBytesOwned(b)
 }
 
+// BufferSink returns a Sink that writes the value into buf, resetting
+// it first. Values served from the cache are copied into buf, so a
+// caller that reuses its buffers avoids allocating on each Get.
+func BufferSink(buf *bytes.Buffer) Sink {
+	if buf == nil {
+		panic("nil buf")
+	}
+	return &bufferSink{buf: buf}
+}
+
+type bufferSink struct {
+	buf *bytes.Buffer
+}
+
+// view copies the buffer's bytes, as the caller may reuse the buffer
+// while the value is cached.
+func (s *bufferSink) view() (ByteView, error) {
+	return ByteView{b: cloneBytes(s.buf.Bytes())}, nil
+}
+
+func (s *bufferSink) setView(v ByteView) error {
+	s.buf.Reset()
+	_, err := v.WriteTo(s.buf)
+	return err
+}
+
+func (s *bufferSink) SetBytes(b []byte) error {
+	s.buf.Reset()
+	s.buf.Write(b)
+	return nil
+}
+
+func (s *bufferSink) SetString(v string) error {
+	s.buf.Reset()
+	s.buf.WriteString(v)
+	return nil
+}
+
+func (s *bufferSink) SetJSON(m interface{}) error {
+	b, err := marshalJSON(m)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(b)
+}
+
+// MultiSink returns a Sink that sets each of sinks to every value it is
+// given, stopping at the first error. Its cached view is that of the
+// first sink.
+func MultiSink(sinks ...Sink) Sink {
+	if len(sinks) == 0 {
+		panic("no Sinks")
+	}
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+func (s multiSink) view() (ByteView, error) {
+	return s[0].view()
+}
+
+func (s multiSink) setView(v ByteView) error {
+	for _, sink := range s {
+		if err := setSinkView(sink, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s multiSink) SetBytes(b []byte) error {
+	for _, sink := range s {
+		if err := sink.SetBytes(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s multiSink) SetString(v string) error {
+	for _, sink := range s {
+		if err := sink.SetString(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetJSON encodes m once and sets each sink to the encoded bytes.
+func (s multiSink) SetJSON(m interface{}) error {
+	b, err := marshalJSON(m)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(b)
+}
+
 // JSONSink returns a sink that unmarshals binary values into m.
 func JSONSink(m interface{}) Sink {
 	return &jsonSink{
@@ -178,12 +304,23 @@ type jsonSink struct {
 	v ByteView
 }
 
+var jsonSinkPool = sync.Pool{
+	New: func() interface{} { return new(jsonSink) },
+}
+
+// reset makes s unmarshal into dst, dropping any view it holds so that
+// a pooled sink doesn't keep a value alive.
+func (s *jsonSink) reset(dst interface{}) {
+	s.dst = dst
+	s.v = ByteView{}
+}
+
 func (s *jsonSink) view() (ByteView, error) {
 	return s.v, nil
 }
 
 func (s *jsonSink) SetBytes(b []byte) error {
-	err := json.Unmarshal(b, s.dst)
+	err := jsonUnmarshal(b, s.dst)
 	if err != nil {
 		return err
 	}
@@ -194,7 +331,7 @@ func (s *jsonSink) SetBytes(b []byte) error {
 
 func (s *jsonSink) SetString(v string) error {
 	b := []byte(v)
-	err := json.Unmarshal(b, s.dst)
+	err := jsonUnmarshal(b, s.dst)
 	if err != nil {
 		return err
 	}
@@ -204,12 +341,144 @@ func (s *jsonSink) SetString(v string) error {
 }
 
 func (s *jsonSink) SetJSON(m interface{}) error {
-	b, err := json.Marshal(m)
+	b, err := marshalJSON(m)
+	if err != nil {
+		return err
+	}
+
+	err = jsonUnmarshal(b, s.dst)
+	if err != nil {
+		return err
+	}
+	s.v.b = b
+	s.v.s = ""
+	return nil
+}
+
+// SafeJSONSink is like JSONSink, but a value that fails to encode or
+// decode doesn't fail the Get. Instead the error is passed to onErr,
+// if it is non-nil, m is set to its zero value, and the sink holds the
+// JSON null, so that is the value cached for the key.
+func SafeJSONSink(m interface{}, onErr func(error)) Sink {
+	return &safeJSONSink{jsonSink: jsonSink{dst: m}, onErr: onErr}
+}
+
+type safeJSONSink struct {
+	jsonSink
+	onErr func(error)
+}
+
+func (s *safeJSONSink) SetBytes(b []byte) error {
+	return s.fallback(s.jsonSink.SetBytes(b))
+}
+
+func (s *safeJSONSink) SetString(v string) error {
+	return s.fallback(s.jsonSink.SetString(v))
+}
+
+func (s *safeJSONSink) SetJSON(m interface{}) error {
+	return s.fallback(s.jsonSink.SetJSON(m))
+}
+
+// fallback replaces the value with the zero value if err is non-nil,
+// and reports err to onErr instead of returning it.
+func (s *safeJSONSink) fallback(err error) error {
+	if err == nil {
+		return nil
+	}
+	if rv := reflect.ValueOf(s.dst); rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+	s.v = ByteView{s: "null"}
+	if s.onErr != nil {
+		s.onErr(err)
+	}
+	return nil
+}
+
+// marshalJSON is like jsonMarshal, except that the bytes of a
+// non-nil json.RawMessage are copied as they are rather than encoded
+// again. They are trusted to be valid JSON.
+func marshalJSON(m interface{}) ([]byte, error) {
+	switch raw := m.(type) {
+	case json.RawMessage:
+		if raw != nil {
+			return cloneBytes(raw), nil
+		}
+	case *json.RawMessage:
+		if raw != nil && *raw != nil {
+			return cloneBytes(*raw), nil
+		}
+	}
+	return jsonMarshal(m)
+}
+
+// jsonMarshal and jsonUnmarshal are the JSON codec set by SetJSONCodec.
+var (
+	jsonMarshal   = json.Marshal
+	jsonUnmarshal = json.Unmarshal
+)
+
+// SetJSONCodec replaces the functions used to encode and decode JSON
+// values by JSONSink, the SetJSON method of every Sink, and the typed
+// Get and Set, which default to those of encoding/json. The functions
+// must behave like json.Marshal and json.Unmarshal. SetJSONCodec is
+// meant to be called during initialization; it must not be called
+// concurrently with any use of the package.
+func SetJSONCodec(marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) {
+	if marshal == nil || unmarshal == nil {
+		panic("nil JSON codec function")
+	}
+	jsonMarshal = marshal
+	jsonUnmarshal = unmarshal
+}
+
+// XMLSink returns a sink that unmarshals XML values into m. Its SetJSON
+// method encodes the value as XML rather than JSON, so that a getter
+// can hand it the same structs it would decode.
+func XMLSink(m interface{}) Sink {
+	return &xmlSink{
+		dst: m,
+	}
+}
+
+type xmlSink struct {
+	dst interface{}
+	v   ByteView
+}
+
+func (s *xmlSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *xmlSink) SetBytes(b []byte) error {
+	err := xml.Unmarshal(b, s.dst)
+	if err != nil {
+		return err
+	}
+	s.v.b = cloneBytes(b)
+	s.v.s = ""
+	return nil
+}
+
+func (s *xmlSink) SetString(v string) error {
+	b := []byte(v)
+	err := xml.Unmarshal(b, s.dst)
+	if err != nil {
+		return err
+	}
+	s.v.b = b
+	s.v.s = ""
+	return nil
+}
+
+func (s *xmlSink) SetJSON(m interface{}) error {
+	b, err := xml.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(b, s.dst)
+	err = xml.Unmarshal(b, s.dst)
 	if err != nil {
 		return err
 	}
@@ -217,3 +486,177 @@ func (s *jsonSink) SetJSON(m interface{}) error {
 	s.v.s = ""
 	return nil
 }
+
+// A ChecksumAlgo is an algorithm by which ChecksumSink checks values.
+type ChecksumAlgo int
+
+const (
+	// CRC32IEEE is CRC-32 with the IEEE polynomial, as used by
+	// hash/crc32.ChecksumIEEE.
+	CRC32IEEE ChecksumAlgo = iota
+
+	// CRC32Castagnoli is CRC-32 with the Castagnoli polynomial.
+	CRC32Castagnoli
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (a ChecksumAlgo) sum(b []byte) uint32 {
+	if a == CRC32Castagnoli {
+		return crc32.Checksum(b, castagnoliTable)
+	}
+	return crc32.ChecksumIEEE(b)
+}
+
+// ErrChecksumMismatch is returned by a ChecksumSink given a value whose
+// checksum is not the expected one.
+var ErrChecksumMismatch = errors.New("cache: checksum mismatch")
+
+// ChecksumSink returns a Sink that checks the checksum of each value
+// it is given by algo against expect, and passes the value on to inner
+// only if they match, failing with ErrChecksumMismatch otherwise. A
+// getter that knows the expected checksum of a value can wrap its dest
+// so that a corrupt value fails the load instead of being cached.
+func ChecksumSink(inner Sink, expect uint32, algo ChecksumAlgo) Sink {
+	return &checksumSink{inner: inner, expect: expect, algo: algo}
+}
+
+type checksumSink struct {
+	inner  Sink
+	expect uint32
+	algo   ChecksumAlgo
+}
+
+func (s *checksumSink) view() (ByteView, error) {
+	return s.inner.view()
+}
+
+func (s *checksumSink) check(b []byte) error {
+	if s.algo.sum(b) != s.expect {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func (s *checksumSink) SetBytes(b []byte) error {
+	if err := s.check(b); err != nil {
+		return err
+	}
+	return s.inner.SetBytes(b)
+}
+
+func (s *checksumSink) SetString(v string) error {
+	if err := s.check(NewStringView(v).unsafeBytes()); err != nil {
+		return err
+	}
+	return s.inner.SetString(v)
+}
+
+func (s *checksumSink) SetJSON(m interface{}) error {
+	b, err := marshalJSON(m)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(b)
+}
+
+// TransformSink returns a Sink that passes each value it is given to
+// fn and the result on to inner, so that values can be normalized, for
+// example trimmed or canonicalized, before they are cached. Values set
+// with SetJSON are encoded as JSON before fn sees them. An error from
+// fn fails the load. Values served from the cache were transformed
+// when they were loaded and are passed to inner as they are.
+func TransformSink(inner Sink, fn func([]byte) ([]byte, error)) Sink {
+	return &transformSink{inner: inner, fn: fn}
+}
+
+type transformSink struct {
+	inner Sink
+	fn    func([]byte) ([]byte, error)
+}
+
+func (s *transformSink) view() (ByteView, error) {
+	return s.inner.view()
+}
+
+func (s *transformSink) setView(v ByteView) error {
+	return setSinkView(s.inner, v)
+}
+
+func (s *transformSink) SetBytes(b []byte) error {
+	// fn gets a copy, as it may modify its argument in place.
+	b, err := s.fn(cloneBytes(b))
+	if err != nil {
+		return err
+	}
+	return s.inner.SetBytes(b)
+}
+
+func (s *transformSink) SetString(v string) error {
+	b, err := s.fn([]byte(v))
+	if err != nil {
+		return err
+	}
+	return s.inner.SetBytes(b)
+}
+
+func (s *transformSink) SetJSON(m interface{}) error {
+	b, err := marshalJSON(m)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(b)
+}
+
+// SetExpiry sets the time at which the value a getter loads into dest
+// expires from the store's cache, such as the expiry of a token the
+// value holds, rather than after a duration. A value that has already
+// expired is handed to the waiting Gets but not cached. A
+// Getter calls SetExpiry on the dest it was given, before or after
+// setting the value; SetExpiry reports false, and does nothing, for
+// sinks not given to a Getter by a Store. The expiry is not passed to
+// the secondary store.
+func SetExpiry(dest Sink, t time.Time) bool {
+	es, ok := dest.(*expirySink)
+	if ok {
+		es.expires = t
+	}
+	return ok
+}
+
+// expirySink wraps the dest of a load to receive its expiry and to
+// record whether the getter set a value.
+type expirySink struct {
+	Sink
+	expires time.Time
+	written bool
+}
+
+func (s *expirySink) SetString(v string) error {
+	s.written = true
+	return s.Sink.SetString(v)
+}
+
+func (s *expirySink) SetBytes(v []byte) error {
+	s.written = true
+	return s.Sink.SetBytes(v)
+}
+
+func (s *expirySink) SetJSON(m interface{}) error {
+	s.written = true
+	return s.Sink.SetJSON(m)
+}
+
+func (s *expirySink) setView(v ByteView) error {
+	s.written = true
+	return setSinkView(s.Sink, v)
+}
+
+// expiresNano returns the expiry as Unix nanoseconds, or 0 if there is
+// none.
+func (s *expirySink) expiresNano() int64 {
+	if s.expires.IsZero() {
+		return 0
+	}
+	return s.expires.UnixNano()
+}
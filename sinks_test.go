@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+func TestSetJSONRawMessage(t *testing.T) {
+	raw := json.RawMessage(`{"Name":"raw","City":"RAW-CITY"}`)
+
+	var s string
+	if err := StringSink(&s).SetJSON(raw); err != nil {
+		t.Fatal(err)
+	}
+	if s != string(raw) {
+		t.Errorf("StringSink got %q; want %q", s, raw)
+	}
+
+	var b []byte
+	if err := AllocatingByteSliceSink(&b).SetJSON(&raw); err != nil {
+		t.Fatal(err)
+	}
+	raw[2] = 'X'
+	if string(b) != `{"Name":"raw","City":"RAW-CITY"}` {
+		t.Errorf("AllocatingByteSliceSink got %q; want a copy of the raw message", b)
+	}
+
+	var m TestMessage
+	if err := JSONSink(&m).SetJSON(json.RawMessage(`{"Name":"raw"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "raw" {
+		t.Errorf("JSONSink got %+v; want Name raw", m)
+	}
+
+	if err := StringSink(&s).SetJSON(json.RawMessage(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if s != "null" {
+		t.Errorf("StringSink got %q for a nil raw message; want %q", s, "null")
+	}
+}
+
+func TestSetJSONCodec(t *testing.T) {
+	var marshals, unmarshals int
+	SetJSONCodec(func(v interface{}) ([]byte, error) {
+		marshals++
+		return json.Marshal(v)
+	}, func(data []byte, v interface{}) error {
+		unmarshals++
+		return json.Unmarshal(data, v)
+	})
+	defer SetJSONCodec(json.Marshal, json.Unmarshal)
+
+	var got map[string]int
+	if err := JSONSink(&got).SetJSON(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got["a"] != 1 {
+		t.Errorf("JSONSink got %v; want a=1", got)
+	}
+	if marshals != 1 || unmarshals != 1 {
+		t.Errorf("codec called %d, %d times; want 1, 1", marshals, unmarshals)
+	}
+}
+
+func TestBufferSink(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v-" + key)
+	}))
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		buf.WriteString("garbage")
+		if err := s.Get("k", BufferSink(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != "v-k" {
+			t.Errorf("Get #%d wrote %q; want %q", i, got, "v-k")
+		}
+		// Reusing the buffer must not change the cached value.
+		buf.Reset()
+		buf.WriteString("XXX")
+	}
+	if v, _ := s.Peek("k"); v.String() != "v-k" {
+		t.Errorf("cached value = %q; want %q", v, "v-k")
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetJSON(map[string]string{"Name": key})
+	}))
+	for i := 0; i < 2; i++ {
+		var str string
+		var tm TestMessage
+		if err := s.Get("fanout", MultiSink(StringSink(&str), JSONSink(&tm))); err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"Name":"fanout"}`; str != want {
+			t.Errorf("Get #%d string = %q; want %q", i, str, want)
+		}
+		if tm.Name != "fanout" {
+			t.Errorf("Get #%d decoded Name = %q; want %q", i, tm.Name, "fanout")
+		}
+	}
+}
+
+func TestXMLSink(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("<TestMessage><Name>" + key + "</Name><City>XML-CITY</City></TestMessage>")
+	}))
+	for i := 0; i < 2; i++ {
+		var tm TestMessage
+		if err := s.Get("legacy", XMLSink(&tm)); err != nil {
+			t.Fatal(err)
+		}
+		if tm.Name != "legacy" || tm.City != "XML-CITY" {
+			t.Errorf("Get #%d = %+v; want Name legacy, City XML-CITY", i, tm)
+		}
+	}
+
+	var tm TestMessage
+	if err := XMLSink(&tm).SetJSON(&TestMessage{Name: "enc"}); err != nil || tm.Name != "enc" {
+		t.Errorf("SetJSON = %+v, %v; want Name enc", tm, err)
+	}
+}
+
+func TestChecksumSink(t *testing.T) {
+	body := "response body"
+	backend := map[string]string{"good": body, "corrupt": body[:5]}
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return ChecksumSink(dest, crc32.ChecksumIEEE([]byte(body)), CRC32IEEE).SetString(backend[key])
+	}))
+	if v, err := s.GetString("good"); err != nil || v != body {
+		t.Errorf("Get(good) = %q, %v; want %q, nil", v, err, body)
+	}
+	if _, err := s.GetString("corrupt"); err != ErrChecksumMismatch {
+		t.Errorf("Get(corrupt) error = %v; want ErrChecksumMismatch", err)
+	}
+	if _, ok := s.Peek("corrupt"); ok {
+		t.Error("corrupt value was cached")
+	}
+
+	var b []byte
+	sum := crc32.Checksum([]byte(body), crc32.MakeTable(crc32.Castagnoli))
+	if err := ChecksumSink(AllocatingByteSliceSink(&b), sum, CRC32Castagnoli).SetBytes([]byte(body)); err != nil {
+		t.Errorf("Castagnoli SetBytes = %v", err)
+	}
+}
+
+func TestSafeJSONSink(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(`{"Name":"partial","City":5}`)
+	}))
+	var errs []error
+	onErr := func(err error) { errs = append(errs, err) }
+	for i := 0; i < 2; i++ {
+		var tm TestMessage
+		if err := s.Get("bad", SafeJSONSink(&tm, onErr)); err != nil {
+			t.Fatal(err)
+		}
+		if tm != (TestMessage{}) {
+			t.Errorf("Get #%d = %+v; want the zero value", i, tm)
+		}
+	}
+	if len(errs) != 1 {
+		t.Errorf("onErr called %d times; want once, for the load", len(errs))
+	}
+	if v, _ := s.Peek("bad"); v.String() != "null" {
+		t.Errorf("cached %q; want null", v.String())
+	}
+
+	tm := TestMessage{Name: "stale"}
+	if err := SafeJSONSink(&tm, nil).SetString("{"); err != nil || tm != (TestMessage{}) {
+		t.Errorf("SetString of bad JSON = %+v, %v; want the zero value", tm, err)
+	}
+	errs = nil
+	if err := SafeJSONSink(&tm, onErr).SetJSON(make(chan int)); err != nil || len(errs) != 1 {
+		t.Errorf("SetJSON of an unencodable value = %v, %d errors", err, len(errs))
+	}
+	if err := SafeJSONSink(&tm, nil).SetJSON(&TestMessage{Name: "ok"}); err != nil || tm.Name != "ok" {
+		t.Errorf("SetJSON = %+v, %v; want Name ok", tm, err)
+	}
+}
+
+func TestTransformSink(t *testing.T) {
+	trim := func(b []byte) ([]byte, error) {
+		return bytes.TrimSpace(b), nil
+	}
+	calls := 0
+	counted := func(b []byte) ([]byte, error) {
+		calls++
+		return trim(b)
+	}
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return TransformSink(dest, trim).SetString("  " + key + "\n")
+	}))
+	if v, err := s.GetString("padded"); err != nil || v != "padded" {
+		t.Errorf("Get = %q, %v; want %q", v, err, "padded")
+	}
+	if v, _ := s.Peek("padded"); v.String() != "padded" {
+		t.Errorf("cached %q; want the transformed value", v.String())
+	}
+
+	// Wrapping the caller's dest transforms loaded values only.
+	raw := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(" raw ")
+	}))
+	for i := 0; i < 2; i++ {
+		var v string
+		if err := raw.Get("k", TransformSink(StringSink(&v), counted)); err != nil || v != "raw" {
+			t.Errorf("Get #%d = %q, %v; want %q", i, v, err, "raw")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("transform called %d times; want 1", calls)
+	}
+
+	fail := errors.New("fail")
+	var v string
+	if err := TransformSink(StringSink(&v), func([]byte) ([]byte, error) { return nil, fail }).SetJSON("x"); err != fail {
+		t.Errorf("SetJSON error = %v; want %v", err, fail)
+	}
+	var tm TestMessage
+	if err := TransformSink(JSONSink(&tm), trim).SetJSON(TestMessage{Name: "json"}); err != nil || tm.Name != "json" {
+		t.Errorf("SetJSON = %+v, %v", tm, err)
+	}
+}
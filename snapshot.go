@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotMagic starts every snapshot, identifying the format and its
+// version.
+const snapshotMagic = "FBCACHE2"
+
+// maxSnapshotField bounds the length of a snapshot field, so that a
+// corrupt length doesn't cause a huge allocation.
+const maxSnapshotField = 1 << 30
+
+// errSnapshotHashedKeys is returned when snapshotting a store with key
+// hashing, whose cached keys can't be mapped back to keys and are
+// salted with a seed chosen at startup.
+var errSnapshotHashedKeys = errors.New("cache: can't snapshot a store with key hashing")
+
+// SaveTo writes the store's cached entries to w, to be restored later
+// with LoadFrom. Entries are written from least to most recently used
+// within each shard, with their expiries and metadata. A value whose
+// expiry slides with each hit is saved with its current expiry, and
+// restored with that as a fixed expiry. Concurrent changes to the cache
+// may or may not be included.
+//
+// The snapshot is the magic string "FBCACHE2" followed by one record
+// per entry: the key and the value, each as its uvarint length followed
+// by its bytes; the uvarint expiry in Unix nanoseconds, or 0 for none;
+// and the uvarint number of metadata pairs followed by the name and
+// value of each, framed as the key is.
+func (s *Store) SaveTo(w io.Writer) error {
+	if s.keyHasher != nil {
+		return errSnapshotHashedKeys
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		bw.WriteString(s)
+	}
+	err := s.cache.each(func(key string, e savedEntry) error {
+		writeString(key)
+		writeUvarint(uint64(e.value.Len()))
+		if _, err := e.value.WriteTo(bw); err != nil {
+			return err
+		}
+		writeUvarint(uint64(e.expires))
+		writeUvarint(uint64(len(e.meta)))
+		for name, v := range e.meta {
+			writeString(name)
+			writeString(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadFrom adds the entries of a snapshot written by SaveTo to the
+// cache, replacing any cached values for the same keys. Entries are
+// added in the order they were saved, so if the snapshot exceeds the
+// store's cacheBytes the least recently used entries are evicted.
+// Entries that have expired since they were saved are skipped. The
+// entries read before an error are kept.
+func (s *Store) LoadFrom(r io.Reader) error {
+	if s.keyHasher != nil {
+		return errSnapshotHashedKeys
+	}
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return fmt.Errorf("cache: reading snapshot header: %v", err)
+	}
+	if string(magic) != snapshotMagic {
+		return errors.New("cache: not a snapshot")
+	}
+	for {
+		key, err := readSnapshotField(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readSnapshotField(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		expires, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		npairs, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		var meta map[string]string
+		for i := uint64(0); i < npairs; i++ {
+			name, err := readSnapshotField(br)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			v, err := readSnapshotField(br)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+			meta[string(name)] = string(v)
+		}
+		if expires != 0 && int64(expires) <= time.Now().UnixNano() {
+			continue
+		}
+		s.populateCache(string(key), ByteView{b: value}, meta, int64(expires), s.cache.generation())
+	}
+}
+
+// unexpectedEOF returns err, or io.ErrUnexpectedEOF if err is io.EOF,
+// for errors reading the middle of a record.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readSnapshotField reads a length-prefixed field. It returns io.EOF
+// only if r is at its end before the field starts.
+func readSnapshotField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(maxSnapshotField) {
+		return nil, fmt.Errorf("cache: snapshot field of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
@@ -1,8 +1,14 @@
 package cache
 
 import (
+	"encoding/binary"
 	"errors"
+	"hash/maphash"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/FeiniuBus/cache/singleflight"
 )
@@ -23,6 +29,74 @@ type GetRemover interface {
 	Remover
 }
 
+var (
+	_ GetRemover = (*Store)(nil)
+	_ GetRemover = (*SubStore)(nil)
+	_ Setter     = (*Store)(nil)
+)
+
+// A Setter stores a value for a key.
+type Setter interface {
+	Set(key string, value ByteView)
+}
+
+// A MultiGetter is a Getter that can populate related keys while
+// loading the requested one. When a Store's getter implements
+// MultiGetter, GetMulti is called instead of Get with the Store
+// itself as set.
+type MultiGetter interface {
+	Getter
+	GetMulti(key string, dest Sink, set Setter) error
+}
+
+// A SecondaryStore is a second cache tier, typically out of process,
+// that a Store consults on a miss in its own cache before invoking its
+// getter. Values loaded by the getter or stored with Set are written
+// through to it.
+type SecondaryStore interface {
+	// Get returns the value for key and whether it was found.
+	Get(key string) (ByteView, bool, error)
+
+	// Set stores value under key.
+	Set(key string, value ByteView) error
+}
+
+// A DistributedLocker provides locks shared by the processes loading
+// into a common SecondaryStore, so that only one of them runs the
+// getter for a cold key while the others wait for its value to appear
+// in the secondary store. It may be backed by Redis, etcd or anything
+// else with such locks.
+type DistributedLocker interface {
+	// Lock tries to take the lock for key without waiting for it.
+	// If acquired, unlock releases it. Lock returns false if another
+	// process holds the lock, or if the lock could not be taken, in
+	// which case the Store waits for the value for a while and then
+	// loads it itself.
+	Lock(key string) (unlock func(), acquired bool)
+}
+
+// DontCache wraps err to tell the Store that the value the getter put
+// in its Sink should be returned to callers but not cached. Get then
+// returns err itself, which may be nil.
+func DontCache(err error) error {
+	return &dontCacheError{err: err}
+}
+
+type dontCacheError struct {
+	err error
+}
+
+func (e *dontCacheError) Error() string {
+	if e.err == nil {
+		return "store: value not cached"
+	}
+	return e.err.Error()
+}
+
+func (e *dontCacheError) Unwrap() error {
+	return e.err
+}
+
 // A GetterFunc implements Getter with a function.
 type GetterFunc func(key string, dest Sink) error
 
@@ -30,6 +104,21 @@ func (f GetterFunc) Get(key string, dest Sink) error {
 	return f(key, dest)
 }
 
+// A MultiGetterFunc implements MultiGetter with a function.
+type MultiGetterFunc func(key string, dest Sink, set Setter) error
+
+func (f MultiGetterFunc) Get(key string, dest Sink) error {
+	return f(key, dest, nopSetter{})
+}
+
+func (f MultiGetterFunc) GetMulti(key string, dest Sink, set Setter) error {
+	return f(key, dest, set)
+}
+
+type nopSetter struct{}
+
+func (nopSetter) Set(key string, value ByteView) {}
+
 var (
 	mu     sync.RWMutex
 	stores = make(map[string]*Store)
@@ -44,8 +133,41 @@ func GetStore(name string) *Store {
 	return s
 }
 
-// NewStore creates a new store
-func NewStore(name string, cacheBytes int64, getter Getter) *Store {
+// Stores returns all stores created with NewStore, sorted by name.
+func Stores() []*Store {
+	mu.RLock()
+	list := make([]*Store, 0, len(stores))
+	for _, s := range stores {
+		list = append(list, s)
+	}
+	mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Unlimited may be passed as cacheBytes to create a store whose cache
+// never evicts entries to stay within a size.
+const Unlimited int64 = math.MaxInt64
+
+// NewStore creates a new store. Its cache holds up to cacheBytes of
+// keys and values, or is unbounded if cacheBytes is Unlimited. A
+// cacheBytes of zero or less disables the cache: every Get loads its
+// value with the getter, though concurrent loads are still shared.
+func NewStore(name string, cacheBytes int64, getter Getter, opts ...Option) *Store {
+	s, err := TryNewStore(name, cacheBytes, getter, opts...)
+	if err != nil {
+		panic("duplicate registration of store " + name)
+	}
+	return s
+}
+
+// ErrStoreExists is returned by TryNewStore when a store with the same
+// name is already registered.
+var ErrStoreExists = errors.New("cache: store already registered")
+
+// TryNewStore is like NewStore, but returns ErrStoreExists instead of
+// panicking if a store named name already exists.
+func TryNewStore(name string, cacheBytes int64, getter Getter, opts ...Option) (*Store, error) {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -53,42 +175,166 @@ func NewStore(name string, cacheBytes int64, getter Getter) *Store {
 	defer mu.Unlock()
 
 	if _, dup := stores[name]; dup {
-		panic("duplicate registration of store " + name)
+		return nil, ErrStoreExists
+	}
+
+	s := newStore(name, cacheBytes, getter, opts)
+	stores[name] = s
+	return s, nil
+}
+
+// NewUnregisteredStore creates a new store that has no name and is not
+// registered, so GetStore and Stores never return it and it can be
+// garbage collected once unreferenced.
+func NewUnregisteredStore(cacheBytes int64, getter Getter, opts ...Option) *Store {
+	if getter == nil {
+		panic("nil Getter")
 	}
+	return newStore("", cacheBytes, getter, opts)
+}
 
+func newStore(name string, cacheBytes int64, getter Getter, opts []Option) *Store {
 	s := &Store{
 		name:       name,
 		getter:     getter,
 		cacheBytes: cacheBytes,
+		cache:      shardedCache{maxPinned: cacheBytes / 2},
 		loadStore:  &singleflight.Store{},
+		logger:     nopLogger{},
 	}
-	stores[name] = s
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.cache.init()
 	return s
 }
 
 // A Store is a cache store
 type Store struct {
-	name       string
-	getter     Getter
-	cacheBytes int64
-	cache      cache
-	loadStore  flightStore
-	_          int32
-	Stats      Stats
+	// Stats, loadLatency and cache come first, so that the 64-bit
+	// words they access atomically are 8-byte aligned on 32-bit
+	// platforms.
+	Stats       Stats
+	loadLatency latencyRecorder
+	cache       shardedCache
+
+	name        string
+	getter      Getter
+	cacheBytes  int64
+	loadStore   flightStore
+	secondary   SecondaryStore
+	keyHasher   func(string) uint64
+	normalize   func(string) string
+	hotKeys     *hotKeys
+	validator   func(key string, value ByteView) error
+	limiter     *keyLimiter
+	admit       func(key string, value ByteView, current, limit int64) bool
+	lfu         *tinyLFU
+	onLoadError func(key string, err error)
+	onEvict     func(key string, value ByteView, reason EvictReason)
+	locker      DistributedLocker
+	lockWait    time.Duration
+	logger      Logger
+	updateMu    [updateStripes]sync.Mutex
+	watermark   float64
+	onWatermark func(stats CacheStats)
+	aboveMark   int32 // accessed atomically
+	keySeed     maphash.Seed
+	subMu       sync.RWMutex
+	subs        []func(key string)
 }
 
+// updateStripes is the number of locks Update spreads keys over.
+const updateStripes = 64
+
 type flightStore interface {
 	Do(key string, fn func() (interface{}, error)) (interface{}, error)
 }
 
-// Stats are store statistics.
+// directFlight is the flight store of a store created
+// WithSingleflight(false). It calls each function without suppressing
+// duplicates.
+type directFlight struct{}
+
+func (directFlight) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return fn()
+}
+
+// ErrTooBusy is returned by Get on a store created WithMaxInFlight when
+// loading the key would exceed the limit.
+var ErrTooBusy = singleflight.ErrTooBusy
+
+// ErrGetterDidNotPopulate is returned by Get when the store's getter
+// returned without error but set no value in its dest. Nothing is
+// cached for the key.
+var ErrGetterDidNotPopulate = errors.New("cache: getter returned nil error but did not populate its sink")
+
+// Stats are store statistics. The counters are updated concurrently,
+// so Stats must not be copied; read each counter with its Get method,
+// or all of them with Store.Snapshot.
 type Stats struct {
+	noCopy noCopy
+
 	Gets          AtomicInt
 	CacheHits     AtomicInt
 	Loads         AtomicInt
 	LoadsDeduped  AtomicInt
 	LocalLoadErrs AtomicInt
 	LocalLoads    AtomicInt
+	SecondaryHits AtomicInt
+	SecondaryErrs AtomicInt
+	StaleGets     AtomicInt
+	LoadsSwept    AtomicInt
+}
+
+// A StatsSnapshot holds the values of a store's Stats counters at one
+// time, as returned by Store.Snapshot.
+type StatsSnapshot struct {
+	Gets          int64
+	CacheHits     int64
+	Loads         int64
+	LoadsDeduped  int64
+	LocalLoadErrs int64
+	LocalLoads    int64
+	SecondaryHits int64
+	SecondaryErrs int64
+	StaleGets     int64
+	LoadsSwept    int64
+}
+
+// Sub returns the field-wise difference s - other, such as the counts
+// made in the interval between an earlier snapshot other and s.
+func (s StatsSnapshot) Sub(other StatsSnapshot) StatsSnapshot {
+	return StatsSnapshot{
+		Gets:          s.Gets - other.Gets,
+		CacheHits:     s.CacheHits - other.CacheHits,
+		Loads:         s.Loads - other.Loads,
+		LoadsDeduped:  s.LoadsDeduped - other.LoadsDeduped,
+		LocalLoadErrs: s.LocalLoadErrs - other.LocalLoadErrs,
+		LocalLoads:    s.LocalLoads - other.LocalLoads,
+		SecondaryHits: s.SecondaryHits - other.SecondaryHits,
+		SecondaryErrs: s.SecondaryErrs - other.SecondaryErrs,
+		StaleGets:     s.StaleGets - other.StaleGets,
+		LoadsSwept:    s.LoadsSwept - other.LoadsSwept,
+	}
+}
+
+// Snapshot returns the current values of the store's Stats counters.
+// Each counter is read atomically, but not all of them at once, so
+// counts made while Snapshot runs may be in some fields and not others.
+func (s *Store) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Gets:          s.Stats.Gets.Get(),
+		CacheHits:     s.Stats.CacheHits.Get(),
+		Loads:         s.Stats.Loads.Get(),
+		LoadsDeduped:  s.Stats.LoadsDeduped.Get(),
+		LocalLoadErrs: s.Stats.LocalLoadErrs.Get(),
+		LocalLoads:    s.Stats.LocalLoads.Get(),
+		SecondaryHits: s.Stats.SecondaryHits.Get(),
+		SecondaryErrs: s.Stats.SecondaryErrs.Get(),
+		StaleGets:     s.Stats.StaleGets.Get(),
+		LoadsSwept:    s.Stats.LoadsSwept.Get(),
+	}
 }
 
 // Name returns the name of the store.
@@ -96,91 +342,950 @@ func (s *Store) Name() string {
 	return s.name
 }
 
-// Remove removes the provided key from the cache.
+// CacheStats returns stats about the store's cache.
+func (s *Store) CacheStats() CacheStats {
+	return s.cache.stats()
+}
+
+// ExpiredItems returns the number of cached items that can no longer be
+// served, because they expired or were made stale by Invalidate, but
+// still take up space until they are evicted or reloaded. Unlike
+// CacheStats, it walks every entry, holding each shard's lock in turn
+// and so delaying writes to the shard; call it sparingly.
+func (s *Store) ExpiredItems() int64 {
+	return s.cache.expired()
+}
+
+// FlightStats returns the stats of the store's duplicate suppression.
+// They are zero for a store whose flight store doesn't keep them.
+func (s *Store) FlightStats() singleflight.Stats {
+	if fs, ok := s.loadStore.(interface{ Stats() singleflight.Stats }); ok {
+		return fs.Stats()
+	}
+	return singleflight.Stats{}
+}
+
+// LoadLatency returns a histogram of how long the getter took to load
+// values, successfully or not.
+func (s *Store) LoadLatency() LatencyHistogram {
+	return s.loadLatency.snapshot()
+}
+
+// ResetStats zeroes the store's Stats counters, its LoadLatency, and
+// the Gets, Hits and Evictions counts of its CacheStats, losing their
+// lifetime totals. Bytes and Items describe the live cache and are
+// kept. Each counter is reset atomically, so ResetStats is safe to call
+// concurrently with Get, but counts made while it runs may land either
+// side of the reset.
+func (s *Store) ResetStats() {
+	for _, i := range []*AtomicInt{
+		&s.Stats.Gets,
+		&s.Stats.CacheHits,
+		&s.Stats.Loads,
+		&s.Stats.LoadsDeduped,
+		&s.Stats.LocalLoadErrs,
+		&s.Stats.LocalLoads,
+		&s.Stats.SecondaryHits,
+		&s.Stats.SecondaryErrs,
+		&s.Stats.StaleGets,
+		&s.Stats.LoadsSwept,
+	} {
+		i.Store(0)
+	}
+	for i := range s.loadLatency {
+		s.loadLatency[i].Store(0)
+	}
+	s.cache.resetStats()
+}
+
+// SizeStats returns stats about the lengths of the store's cached
+// values.
+func (s *Store) SizeStats() SizeStats {
+	return s.cache.sizeStats()
+}
+
+// Available returns how many more bytes the cache can hold before it
+// evicts, or 0 if caching is disabled. With more than one shard, each
+// shard has an equal part of the budget, so a shard may evict while
+// the store as a whole has bytes available.
+func (s *Store) Available() int64 {
+	if s.cacheBytes <= 0 {
+		return 0
+	}
+	if n := s.cacheBytes - s.cache.bytes(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Fullness returns the fraction of the cache's budget in use, from 0
+// for empty to 1 for full. A store with caching disabled is always
+// full.
+func (s *Store) Fullness() float64 {
+	if s.cacheBytes <= 0 {
+		return 1
+	}
+	f := float64(s.cache.bytes()) / float64(s.cacheBytes)
+	if f > 1 {
+		return 1
+	}
+	return f
+}
+
+// Peek returns the cached value for key without invoking the getter
+// or updating the key's recency.
+func (s *Store) Peek(key string) (value ByteView, ok bool) {
+	return s.peek(s.normalizeKey(key))
+}
+
+// peek implements Peek for a normalized key.
+func (s *Store) peek(key string) (value ByteView, ok bool) {
+	if s.cacheBytes <= 0 {
+		return
+	}
+	return s.cache.peek(s.cacheKey(key))
+}
+
+// EntryInfo returns metadata about the cached entry for key without
+// updating its recency.
+func (s *Store) EntryInfo(key string) (EntryInfo, bool) {
+	key = s.normalizeKey(key)
+	if s.cacheBytes <= 0 {
+		return EntryInfo{}, false
+	}
+	return s.cache.info(s.cacheKey(key))
+}
+
+// Touch makes the cached value for key expire ttl from now, or never if
+// ttl <= 0, without reloading it or updating its recency. An expired
+// value is treated as absent, so the next Get reloads it. Touch
+// reports whether a live value was cached for key.
+func (s *Store) Touch(key string, ttl time.Duration) bool {
+	key = s.normalizeKey(key)
+	if s.cacheBytes <= 0 {
+		return false
+	}
+	return s.cache.touch(s.cacheKey(key), ttl)
+}
+
+// Pin exempts the value cached under key from eviction until Unpin is
+// called, for keys such as configuration that must stay cached while
+// others churn. Pinned values still count toward the cache's size, but
+// together they may take at most half of it, or the amount set by
+// WithMaxPinnedBytes. A value set for a pinned key stays pinned as long
+// as it fits. Remove, RemovePrefix and Flush remove pinned values as
+// usual, and a pinned value made stale by Invalidate or expiry is
+// dropped when the cache needs room. Pin reports whether the value is
+// pinned; it returns false if key isn't cached or its value doesn't
+// fit.
+func (s *Store) Pin(key string) bool {
+	key = s.normalizeKey(key)
+	if s.cacheBytes <= 0 {
+		return false
+	}
+	return s.cache.pin(s.cacheKey(key))
+}
+
+// Unpin makes the value pinned under key evictable again, as the most
+// recently used value. It reports whether the value was pinned.
+func (s *Store) Unpin(key string) bool {
+	key = s.normalizeKey(key)
+	if s.cacheBytes <= 0 {
+		return false
+	}
+	return s.cache.unpin(s.cacheKey(key))
+}
+
+// HotKeys returns up to n keys whose loads were most often shared by
+// concurrent callers, in decreasing order of their estimated dedup
+// counts. It returns nil if n <= 0 or unless the store was created with
+// WithHotKeyTracking.
+func (s *Store) HotKeys(n int) []KeyStat {
+	if s.hotKeys == nil || n <= 0 {
+		return nil
+	}
+	return s.hotKeys.top(n)
+}
+
+// PendingLoads returns the number of loads currently in flight.
+func (s *Store) PendingLoads() int {
+	if p, ok := s.loadStore.(interface {
+		Pending() int
+	}); ok {
+		return p.Pending()
+	}
+	return 0
+}
+
+// SweepLoads forgets the loads that have been in flight for more than
+// maxAge, such as those of a getter that hangs, so that the calls they
+// hold don't pile up and later Gets for their keys start new loads
+// rather than wait. A forgotten load no longer counts toward
+// WithMaxInFlight. Gets already waiting on a forgotten load keep
+// waiting for it. SweepLoads returns the number of loads forgotten,
+// adds it to Stats.LoadsSwept and logs it. It is meant to be called
+// periodically, with maxAge well above the getter's slowest expected
+// load.
+func (s *Store) SweepLoads(maxAge time.Duration) int {
+	sw, ok := s.loadStore.(interface {
+		Sweep(maxAge time.Duration) int
+	})
+	if !ok {
+		return 0
+	}
+	n := sw.Sweep(maxAge)
+	if n > 0 {
+		s.Stats.LoadsSwept.Add(int64(n))
+		s.logger.Printf("cache: store %q: swept %d loads in flight for over %v", s.name, n, maxAge)
+	}
+	return n
+}
+
+// Set stores value in the cache under key, replacing any existing
+// value, without invoking the getter. The value is also written
+// through to the secondary store, if any.
+func (s *Store) Set(key string, value ByteView) {
+	s.set(s.normalizeKey(key), value)
+}
+
+// set implements Set for a normalized key.
+func (s *Store) set(key string, value ByteView) {
+	s.populateCache(key, value, nil, 0, s.cache.generation())
+	s.setSecondary(key, value)
+}
+
+// Update atomically replaces the value cached under key with the one
+// returned by fn, which is passed the current value and whether there
+// is one; if fn returns false the value is removed instead, and if it
+// returns an error the cache is left alone and Update returns the
+// error. Updates of the same key are serialized by a per-key lock, so
+// values such as counters can be kept in the cache without other
+// synchronization. Set, Remove and loads don't take the lock and may
+// interleave with an Update. fn must not call Update on the store.
+// Update never calls the getter; new values are stored as by Set.
+func (s *Store) Update(key string, fn func(old ByteView, existed bool) (ByteView, bool, error)) error {
+	key = s.normalizeKey(key)
+	mu := &s.updateMu[fnv64a(key)%updateStripes]
+	mu.Lock()
+	defer mu.Unlock()
+	old, existed := s.peek(key)
+	v, keep, err := fn(old, existed)
+	if err != nil {
+		return err
+	}
+	if keep {
+		s.set(key, v)
+	} else if existed {
+		s.remove(key)
+	}
+	return nil
+}
+
+// SetWithMeta is like Set, but also stores meta with the value, such as
+// the headers of a cached response. The metadata counts toward the
+// cache's size, is not written to the secondary store, and is returned
+// by GetWithMeta while the value stays cached. meta is copied.
+func (s *Store) SetWithMeta(key string, value ByteView, meta map[string]string) {
+	key = s.normalizeKey(key)
+	s.populateCache(key, value, copyMeta(meta), 0, s.cache.generation())
+	s.setSecondary(key, value)
+}
+
+// GetOrSet populates dest with the value cached under key if there is
+// one, and otherwise caches value under key and populates dest with it,
+// without invoking the getter. The check and the store happen under a
+// single lock, so concurrent callers agree on one value. If the store
+// doesn't cache, or its admission policy rejects value, dest is
+// populated with value and it is not cached.
+func (s *Store) GetOrSet(key string, value ByteView, dest Sink) error {
+	key = s.normalizeKey(key)
+	s.Stats.Gets.Add(1)
+	if dest == nil {
+		return errors.New("store: nil dest Sink")
+	}
+	if s.cacheBytes <= 0 {
+		return setSinkView(dest, value)
+	}
+	ckey := s.cacheKey(key)
+	victim := s.cache.shard(ckey)
+	if s.lfu != nil {
+		s.lfu.increment(ckey)
+	}
+	if !s.admits(key, ckey, value, victim) {
+		// A value already cached is still returned in place of the
+		// rejected one.
+		if v, _, ok := victim.get(ckey, 0); ok {
+			s.Stats.CacheHits.Add(1)
+			return setSinkView(dest, v)
+		}
+		return setSinkView(dest, value)
+	}
+	actual, loaded, evicted := victim.getOrAdd(ckey, value, s.cache.generation(), s.cache.limit(s.cacheBytes))
+	if loaded {
+		s.Stats.CacheHits.Add(1)
+	} else {
+		s.setSecondary(key, value)
+		s.notifyEvicted(evicted)
+		s.checkWatermark()
+	}
+	return setSinkView(dest, actual)
+}
+
+// Remove removes the provided key from the cache. It does not remove
+// the key from the secondary store, if any.
 func (s *Store) Remove(key string) {
-	s.cache.remove(key)
+	s.remove(s.normalizeKey(key))
+}
+
+// remove implements Remove for a normalized key.
+func (s *Store) remove(key string) {
+	evs := s.cache.remove(s.cacheKey(key))
+	s.notify(key)
+	s.reportEvicted(evs)
+}
+
+// Keys returns the keys currently cached, from the most to the least
+// recently used within each shard. With key hashing the original keys
+// are not kept, so Keys returns nil.
+func (s *Store) Keys() []string {
+	return s.keysWithPrefix("")
+}
+
+func (s *Store) keysWithPrefix(prefix string) []string {
+	if s.keyHasher != nil {
+		return nil
+	}
+	return s.cache.keys(prefix)
+}
+
+// Invalidate makes every value currently cached, or being loaded,
+// stale, so that later calls to Get load them again. It takes constant
+// time: stale entries keep their memory until they are replaced or
+// evicted. Invalidate does not affect the secondary store, if any.
+func (s *Store) Invalidate() {
+	s.cache.invalidate()
+}
+
+// RemovePrefix removes all keys starting with prefix from the cache and
+// returns the number of keys removed. Subscribers are notified of each
+// removed key. With key hashing the original keys are not kept, so
+// RemovePrefix removes nothing.
+func (s *Store) RemovePrefix(prefix string) int {
+	if s.keyHasher != nil {
+		return 0
+	}
+	evs := s.cache.removePrefix(prefix)
+	s.notifyEvicted(evs)
+	return len(evs)
+}
+
+// Flush removes every entry from the cache, releasing its memory, and
+// notifies subscribers of each removed key. Unlike Invalidate, it takes
+// time proportional to the number of entries.
+func (s *Store) Flush() {
+	s.notifyEvicted(s.cache.clear())
+}
+
+// RemoveAll removes the provided keys from the cache, taking each lock
+// once rather than once per key. Like Remove, it notifies subscribers
+// of every key, cached or not.
+func (s *Store) RemoveAll(keys []string) {
+	if s.normalize != nil {
+		normalized := make([]string, len(keys))
+		for i, key := range keys {
+			normalized[i] = s.normalize(key)
+		}
+		keys = normalized
+	}
+	var evs []eviction
+	if s.keyHasher != nil {
+		hashed := make([]string, len(keys))
+		for i, key := range keys {
+			hashed[i] = s.cacheKey(key)
+		}
+		evs = s.cache.removeKeys(hashed)
+	} else {
+		evs = s.cache.removeKeys(keys)
+	}
+	for _, key := range keys {
+		s.notify(key)
+	}
+	s.reportEvicted(evs)
+}
+
+// Subscribe registers fn to be called with the key of every entry
+// that leaves the cache, whether by Remove or by eviction. With key
+// hashing, evictions are not reported, as the original keys are not
+// kept. Remove always notifies, even when the key was not cached, so
+// calls to Remove can be re-broadcast to other processes; plumbing that
+// calls Remove on behalf of remote invalidations should take care not
+// to re-broadcast those. fn is called synchronously, outside of the
+// store's locks.
+func (s *Store) Subscribe(fn func(key string)) {
+	s.subMu.Lock()
+	s.subs = append(s.subs, fn)
+	s.subMu.Unlock()
+}
+
+func (s *Store) notify(key string) {
+	s.subMu.RLock()
+	subs := s.subs
+	s.subMu.RUnlock()
+	for _, fn := range subs {
+		fn(key)
+	}
 }
 
 // Get is
 func (s *Store) Get(key string, dest Sink) error {
-	s.Stats.Gets.Add(1)
+	_, _, err := s.get(s.normalizeKey(key), dest, getOpts{})
+	return err
+}
+
+// GetChecked is like Get, but also reports whether the value was
+// served from the cache rather than loaded by the getter, the
+// secondary store or a concurrent call. hit is false if err is not
+// nil.
+func (s *Store) GetChecked(key string, dest Sink) (hit bool, err error) {
+	meta, _, err := s.get(s.normalizeKey(key), dest, getOpts{})
+	if err != nil {
+		return false, err
+	}
+	return meta.Source == SourceCache && !meta.Shared, nil
+}
+
+// A Source is where a Get found its value.
+type Source int
+
+const (
+	// SourceCache is the store's own cache.
+	SourceCache Source = iota
+
+	// SourceGetter is the store's getter.
+	SourceGetter
+
+	// SourceSecondary is the store's secondary store.
+	SourceSecondary
+)
+
+// Meta describes how a Get got its value.
+type Meta struct {
+	Source Source
+
+	// Shared is whether the value came from a load started by a
+	// concurrent Get for the same key.
+	Shared bool
+
+	// LoadDuration is how long the Get spent loading the value or
+	// waiting for a concurrent load, or 0 if it was cached.
+	LoadDuration time.Duration
+}
+
+// GetWithMetadata is like Get, but also describes where the value came
+// from.
+func (s *Store) GetWithMetadata(key string, dest Sink) (Meta, error) {
+	meta, _, err := s.get(s.normalizeKey(key), dest, getOpts{})
+	return meta, err
+}
+
+// GetDeduped is like Get, but also reports whether the value came from
+// a load started by a concurrent Get for the same key, rather than one
+// this call paid for or a cache hit, as Meta.Shared does for
+// GetWithMetadata.
+func (s *Store) GetDeduped(key string, dest Sink) (deduped bool, err error) {
+	meta, _, err := s.get(s.normalizeKey(key), dest, getOpts{})
+	return meta.Shared, err
+}
+
+// GetOrDefault is like Get, but if Get would return an error it
+// populates dest with def instead and returns nil, so that callers can
+// degrade gracefully while the getter fails. def is not cached. Use
+// WithOnLoadError to observe the failures.
+func (s *Store) GetOrDefault(key string, dest Sink, def ByteView) error {
 	if dest == nil {
 		return errors.New("store: nil dest Sink")
 	}
-	value, cacheHit := s.lookupCache(key)
+	if err := s.Get(key, dest); err == nil {
+		return nil
+	}
+	return setSinkView(dest, def)
+}
+
+// GetFresh is like Get, but treats a cached value loaded more than
+// maxAge ago as a miss and reloads it, leaving other callers free to
+// accept older values. A GetFresh that joins a load already in
+// progress for the key takes its result.
+func (s *Store) GetFresh(key string, dest Sink, maxAge time.Duration) error {
+	_, _, err := s.get(s.normalizeKey(key), dest, getOpts{maxAge: maxAge})
+	return err
+}
+
+// GetStale populates dest with the value cached under key and reports
+// whether there was one, without ever invoking the getter, consulting
+// the secondary store or waiting on a load in flight. It is meant for
+// best-effort reads, such as dashboards polling many keys. Unlike Get
+// it counts only Stats.StaleGets, and like Peek it leaves the entry's
+// recency alone.
+func (s *Store) GetStale(key string, dest Sink) (found bool) {
+	s.Stats.StaleGets.Add(1)
+	value, ok := s.Peek(key)
+	if !ok || dest == nil {
+		return false
+	}
+	return setSinkView(dest, value) == nil
+}
+
+// GetWithMeta is like Get, but also returns the metadata stored with
+// the value by SetWithMeta. Values without metadata, including those
+// loaded by the getter or returned by a load shared with another call,
+// have nil metadata. The returned map is a copy.
+func (s *Store) GetWithMeta(key string, dest Sink) (map[string]string, error) {
+	var meta map[string]string
+	_, _, err := s.get(s.normalizeKey(key), dest, getOpts{meta: &meta})
+	if err != nil {
+		return nil, err
+	}
+	return copyMeta(meta), nil
+}
+
+// GetNoStore is like Get, but a value it loads is not added to the
+// cache or the secondary store, so that one-off reads such as scans
+// don't evict hot entries. It still returns cached values, and shares
+// a load with concurrent Gets for the same key; if GetNoStore started
+// that load, its value is not cached for them either.
+func (s *Store) GetNoStore(key string, dest Sink) error {
+	_, _, err := s.get(s.normalizeKey(key), dest, getOpts{noStore: true})
+	return err
+}
+
+// GetManyDeduped gets the value of each of keys into the dest at the
+// same index, and returns the error of each Get in the same way; dests
+// must be as long as keys. Repeated keys are looked up or loaded only
+// once, by the first dest for the key, whose value or error is then
+// given to the others.
+func (s *Store) GetManyDeduped(keys []string, dests []Sink) []error {
+	if len(dests) != len(keys) {
+		panic("cache: GetManyDeduped needs a dest for each key")
+	}
+	errs := make([]error, len(keys))
+	first := make(map[string]int, len(keys))
+	for i, key := range keys {
+		key = s.normalizeKey(key)
+		j, seen := first[key]
+		if !seen {
+			first[key] = i
+			_, _, errs[i] = s.get(key, dests[i], getOpts{})
+			continue
+		}
+		if dests[i] == nil {
+			errs[i] = errors.New("store: nil dest Sink")
+			continue
+		}
+		if errs[j] != nil {
+			errs[i] = errs[j]
+			continue
+		}
+		v, err := dests[j].view()
+		if err == nil {
+			err = setSinkView(dests[i], v)
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// LoadIfAbsent is like Get, but also reports whether this call loaded
+// the value with the getter. It returns false when the value was
+// cached or loaded by a concurrent call.
+func (s *Store) LoadIfAbsent(key string, dest Sink) (loaded bool, err error) {
+	_, loaded, err = s.get(s.normalizeKey(key), dest, getOpts{})
+	return loaded, err
+}
+
+// getOpts adjust a single get.
+type getOpts struct {
+	// noStore is whether a loaded value is not to be cached.
+	noStore bool
+
+	// maxAge, if positive, is the age beyond which a cached value is
+	// treated as a miss.
+	maxAge time.Duration
+
+	// meta, if set, receives the metadata of a cached value.
+	meta *map[string]string
+}
+
+// get implements Get for a normalized key, describing where the value
+// came from and reporting whether this call ran the getter.
+func (s *Store) get(key string, dest Sink, opts getOpts) (meta Meta, loaded bool, err error) {
+	s.Stats.Gets.Add(1)
+	if dest == nil {
+		return meta, false, errors.New("store: nil dest Sink")
+	}
+	if s.lfu != nil {
+		s.lfu.increment(s.cacheKey(key))
+	}
+	value, cacheHit := s.lookupCache(key, opts)
 
 	if cacheHit {
 		s.Stats.CacheHits.Add(1)
-		return setSinkView(dest, value)
+		return meta, false, setSinkView(dest, value)
 	}
 
 	destPopulated := false
-	value, destPopulated, err := s.load(key, dest)
+	start := time.Now()
+	value, meta, destPopulated, err = s.load(key, dest, opts)
+	meta.LoadDuration = time.Since(start)
 	if err != nil {
-		return err
+		var dc *dontCacheError
+		if !errors.As(err, &dc) {
+			return meta, false, err
+		}
+		// The value is good but was not cached; hand it out along
+		// with the getter's own error.
+		err = dc.err
 	}
 	if destPopulated {
-		return nil
+		return meta, true, err
 	}
-	return setSinkView(dest, value)
+	if serr := setSinkView(dest, value); serr != nil {
+		return meta, false, serr
+	}
+	return meta, false, err
+}
+
+// GetBytes is like Get, returning the value as a newly allocated
+// byte slice.
+func (s *Store) GetBytes(key string) ([]byte, error) {
+	var b []byte
+	sink := allocBytesSinkPool.Get().(*allocBytesSink)
+	sink.reset(&b)
+	err := s.Get(key, sink)
+	sink.reset(nil)
+	allocBytesSinkPool.Put(sink)
+	return b, err
+}
+
+// GetString is like Get, returning the value as a string.
+func (s *Store) GetString(key string) (string, error) {
+	var v string
+	sink := stringSinkPool.Get().(*stringSink)
+	sink.reset(&v)
+	err := s.Get(key, sink)
+	sink.reset(nil)
+	stringSinkPool.Put(sink)
+	return v, err
+}
+
+// loadResult is the result of a shared load.
+type loadResult struct {
+	value  ByteView
+	source Source
+
+	// store is the store that ran the load, and expires the value's
+	// expiry, for a store joining a load through a shared flight store.
+	store   *Store
+	expires int64
 }
 
-// load loads key by invoking the getter locally
-func (s *Store) load(key string, dest Sink) (value ByteView, destPopulated bool, err error) {
+// load loads key by invoking the getter locally. meta's Source is
+// where the load found the value, which may be the cache if another
+// load filled it first.
+func (s *Store) load(key string, dest Sink, opts getOpts) (value ByteView, meta Meta, destPopulated bool, err error) {
 	s.Stats.Loads.Add(1)
-	viewi, err := s.loadStore.Do(key, func() (interface{}, error) {
-		if value, cacheHit := s.lookupCache(key); cacheHit {
+	ran := false
+	defer func() {
+		// A call that didn't run its own function joined another
+		// caller's load, unless it was turned away.
+		if !ran && err != ErrTooBusy && s.hotKeys != nil {
+			s.hotKeys.add(key)
+		}
+	}()
+	joinGen := s.cache.generation()
+	resi, err := s.loadStore.Do(key, func() (interface{}, error) {
+		ran = true
+		if value, cacheHit := s.lookupCache(key, opts); cacheHit {
 			s.Stats.CacheHits.Add(1)
-			return value, nil
+			return loadResult{value, SourceCache, s, 0}, nil
+		}
+		if _, direct := s.loadStore.(directFlight); !direct {
+			s.Stats.LoadsDeduped.Add(1)
+		}
+		// Note the generation before loading, so that a value loaded
+		// across a call to Invalidate is stale.
+		gen := s.cache.generation()
+		if value, ok := s.getSecondary(key); ok && s.validate(key, value) == nil {
+			s.Stats.SecondaryHits.Add(1)
+			if !opts.noStore {
+				s.populateCache(key, value, nil, 0, gen)
+			}
+			return loadResult{value, SourceSecondary, s, 0}, nil
+		}
+		value, found, unlock := s.awaitPeerLoad(key)
+		if found {
+			s.Stats.SecondaryHits.Add(1)
+			if !opts.noStore {
+				s.populateCache(key, value, nil, 0, gen)
+			}
+			return loadResult{value, SourceSecondary, s, 0}, nil
+		}
+		if unlock != nil {
+			// Hold the lock until the value is written to the
+			// secondary store.
+			defer unlock()
+		}
+		if s.limiter != nil {
+			if err := s.limiter.allow(key); err != nil {
+				return nil, err
+			}
 		}
-		s.Stats.LoadsDeduped.Add(1)
-		var value ByteView
 		var err error
-		value, err = s.getLocally(key, dest)
+		start := time.Now()
+		ed := &expirySink{Sink: dest}
+		value, err = s.getLocally(key, ed)
+		s.loadLatency.record(time.Since(start))
+		if err == nil {
+			err = s.validate(key, value)
+		}
+		if s.limiter != nil {
+			s.limiter.done(key, err)
+		}
 		if err != nil {
+			var dc *dontCacheError
+			if errors.As(err, &dc) {
+				s.Stats.LocalLoads.Add(1)
+				destPopulated = true
+				return loadResult{value, SourceGetter, s, 0}, err
+			}
 			s.Stats.LocalLoadErrs.Add(1)
+			if s.onLoadError != nil {
+				s.onLoadError(key, err)
+			}
 			return nil, err
 		}
 		s.Stats.LocalLoads.Add(1)
 		destPopulated = true
-		s.populateCache(key, value)
-		return value, nil
+		if !opts.noStore {
+			s.populateCache(key, value, nil, ed.expiresNano(), gen)
+			s.setSecondary(key, value)
+		}
+		return loadResult{value, SourceGetter, s, ed.expiresNano()}, nil
 	})
-	if err == nil {
-		value = viewi.(ByteView)
+	if errors.Is(err, singleflight.ErrPanicked) {
+		s.logger.Printf("cache: store %q: load %q: %v", s.name, key, err)
 	}
+	meta.Source = SourceGetter
+	if res, ok := resi.(loadResult); ok {
+		value, meta.Source = res.value, res.source
+		if err == nil && res.store != s && !opts.noStore {
+			// Another store sharing the flight store loaded the
+			// value, into its own cache only.
+			s.populateCache(key, value, nil, res.expires, joinGen)
+		}
+	}
+	meta.Shared = !ran && err != ErrTooBusy
 	return
 }
 
-func (s *Store) getLocally(key string, dest Sink) (ByteView, error) {
-	err := s.getter.Get(key, dest)
+// awaitPeerLoad coordinates a load of key that missed the secondary
+// store with the other processes sharing it, through the store's
+// DistributedLocker. If another process holds the lock, it polls the
+// secondary store until the value appears or lockWait passes, and
+// returns the value if found. Otherwise the key is this process's to
+// load, and if it took the lock, unlock releases it; the secondary
+// store is checked again first, as a peer may have just loaded it.
+func (s *Store) awaitPeerLoad(key string) (value ByteView, found bool, unlock func()) {
+	if s.locker == nil || s.secondary == nil {
+		return ByteView{}, false, nil
+	}
+	unlock, acquired := s.locker.Lock(key)
+	if acquired {
+		if value, ok := s.getSecondary(key); ok && s.validate(key, value) == nil {
+			unlock()
+			return value, true, nil
+		}
+		return ByteView{}, false, unlock
+	}
+	poll := s.lockWait / 20
+	if poll < time.Millisecond {
+		poll = time.Millisecond
+	}
+	for deadline := time.Now().Add(s.lockWait); time.Now().Before(deadline); {
+		time.Sleep(poll)
+		if value, ok := s.getSecondary(key); ok && s.validate(key, value) == nil {
+			return value, true, nil
+		}
+	}
+	return ByteView{}, false, nil
+}
+
+func (s *Store) getLocally(key string, dest *expirySink) (ByteView, error) {
+	var err error
+	if mg, ok := s.getter.(MultiGetter); ok {
+		err = mg.GetMulti(key, dest, s)
+	} else {
+		err = s.getter.Get(key, dest)
+	}
 	if err != nil {
-		return ByteView{}, err
+		var dc *dontCacheError
+		if !errors.As(err, &dc) {
+			return ByteView{}, err
+		}
+		if !dest.written {
+			return ByteView{}, ErrGetterDidNotPopulate
+		}
+		value, verr := dest.view()
+		if verr != nil {
+			return ByteView{}, verr
+		}
+		return value, err
+	}
+	if !dest.written {
+		return ByteView{}, ErrGetterDidNotPopulate
 	}
 	return dest.view()
 }
 
-func (s *Store) lookupCache(key string) (value ByteView, ok bool) {
+// validate checks a loaded value with the store's validator, if any.
+func (s *Store) validate(key string, value ByteView) error {
+	if s.validator == nil {
+		return nil
+	}
+	return s.validator(key, value)
+}
+
+// getSecondary looks key up in the secondary store, if any. Errors
+// are counted and treated as misses so that the getter is used as a
+// fallback.
+func (s *Store) getSecondary(key string) (ByteView, bool) {
+	if s.secondary == nil {
+		return ByteView{}, false
+	}
+	value, ok, err := s.secondary.Get(key)
+	if err != nil {
+		s.Stats.SecondaryErrs.Add(1)
+		s.logger.Printf("cache: store %q: secondary get %q: %v", s.name, key, err)
+		return ByteView{}, false
+	}
+	return value, ok
+}
+
+func (s *Store) setSecondary(key string, value ByteView) {
+	if s.secondary == nil {
+		return
+	}
+	if err := s.secondary.Set(key, value); err != nil {
+		s.Stats.SecondaryErrs.Add(1)
+		s.logger.Printf("cache: store %q: secondary set %q: %v", s.name, key, err)
+	}
+}
+
+// normalizeKey returns key normalized by the store's key normalizer,
+// if any.
+func (s *Store) normalizeKey(key string) string {
+	if s.normalize == nil {
+		return key
+	}
+	return s.normalize(key)
+}
+
+// cacheKey returns the key under which key is cached. With key hashing
+// it is the 16-byte concatenation of the key's hash from keyHasher and
+// its maphash under the store's seed, so that two keys only collide if
+// both independent 64-bit hashes do.
+func (s *Store) cacheKey(key string) string {
+	if s.keyHasher == nil {
+		return key
+	}
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], s.keyHasher(key))
+	binary.LittleEndian.PutUint64(b[8:], maphash.String(s.keySeed, key))
+	return string(b[:])
+}
+
+func (s *Store) lookupCache(key string, opts getOpts) (value ByteView, ok bool) {
 	if s.cacheBytes <= 0 {
 		return
 	}
-	value, ok = s.cache.get(key)
+	var meta map[string]string
+	value, meta, ok = s.cache.get(s.cacheKey(key), opts.maxAge)
+	if ok && opts.meta != nil {
+		*opts.meta = meta
+	}
 	return
 }
 
-func (s *Store) populateCache(key string, value ByteView) {
+func (s *Store) populateCache(key string, value ByteView, meta map[string]string, expires, gen int64) {
 	if s.cacheBytes <= 0 {
 		return
 	}
-	s.cache.add(key, value)
+	ckey := s.cacheKey(key)
+	victim := s.cache.shard(ckey)
+	if expires != 0 && expires <= time.Now().UnixNano() || !s.admits(key, ckey, value, victim) {
+		// Drop any older value rather than keep serving it.
+		s.notifyEvicted(victim.remove(ckey))
+		return
+	}
+	s.notifyEvicted(victim.add(ckey, value, meta, expires, gen, s.cache.limit(s.cacheBytes)))
+	s.checkWatermark()
+}
 
-	for {
-		cacheBytes := s.cache.bytes()
-		if cacheBytes <= s.cacheBytes {
-			return
-		}
+// checkWatermark calls the WithHighWatermark callback if the cache has
+// just crossed its watermark, and rearms it once the cache drops back.
+func (s *Store) checkWatermark() {
+	if s.onWatermark == nil {
+		return
+	}
+	if float64(s.cache.bytes()) <= s.watermark*float64(s.cacheBytes) {
+		atomic.StoreInt32(&s.aboveMark, 0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.aboveMark, 0, 1) {
+		s.onWatermark(s.CacheStats())
+	}
+}
+
+// admits reports whether the store's admission policies let value be
+// cached under key, whose cache key is ckey, in victim.
+func (s *Store) admits(key, ckey string, value ByteView, victim *cache) bool {
+	if s.admit != nil && !s.admit(key, value, victim.bytes(), s.cache.limit(s.cacheBytes)) {
+		return false
+	}
+	return s.lfu == nil || s.admitLFU(ckey, value, victim)
+}
+
+// admitLFU reports whether value should be cached under ckey in
+// victim: either it fits without an eviction, or ckey is requested more
+// often than the key that would be evicted.
+func (s *Store) admitLFU(ckey string, value ByteView, victim *cache) bool {
+	if victim.bytes()+victim.costOf(ckey, value) <= s.cache.limit(s.cacheBytes) {
+		return true
+	}
+	oldest, ok := victim.oldest()
+	if !ok || oldest == ckey {
+		return true
+	}
+	return s.lfu.estimate(ckey) > s.lfu.estimate(oldest)
+}
+
+// notifyEvicted notifies subscribers of the keys of evicted entries and
+// reports the entries to the WithOnEvict callback.
+func (s *Store) notifyEvicted(evicted []eviction) {
+	if s.keyHasher != nil {
+		return
+	}
+	for _, ev := range evicted {
+		s.notify(ev.key)
+	}
+	s.reportEvicted(evicted)
+}
 
-		victim := &s.cache
-		victim.removeOldest()
+// reportEvicted reports evicted entries to the WithOnEvict callback.
+func (s *Store) reportEvicted(evicted []eviction) {
+	if s.onEvict == nil || s.keyHasher != nil {
+		return
+	}
+	for _, ev := range evicted {
+		s.onEvict(ev.key, ev.value, ev.reason)
 	}
 }
@@ -1,11 +1,22 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/FeiniuBus/cache/lru"
+	"github.com/FeiniuBus/cache/singleflight"
 )
 
 var (
@@ -62,7 +73,7 @@ func TestGetDupSuppressString(t *testing.T) {
 		}()
 	}
 
-	time.Sleep(250 * time.Millisecond)
+	waitForDups(t, stringStore, fromChan, 1)
 
 	stringc <- "foo"
 
@@ -91,7 +102,7 @@ func TestGetDupSuppressJSON(t *testing.T) {
 		}()
 	}
 
-	time.Sleep(250 * time.Millisecond)
+	waitForDups(t, jsonStore, fromChan, 1)
 
 	stringc <- "Fluffy"
 	want := &TestMessage{
@@ -112,6 +123,21 @@ func TestGetDupSuppressJSON(t *testing.T) {
 	}
 }
 
+// waitForDups waits until n callers are waiting on the load of key in
+// progress in s besides the one running it, failing t if they don't
+// arrive within 5 seconds.
+func waitForDups(t *testing.T, s Getter, key string, n int) {
+	t.Helper()
+	sf := s.(*Store).loadStore.(*singleflight.Store)
+	deadline := time.Now().Add(5 * time.Second)
+	for sf.Waiters(key) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting on %q; want %d", sf.Waiters(key), key, n)
+		}
+		runtime.Gosched()
+	}
+}
+
 func countFills(f func()) int64 {
 	fills0 := cacheFills.Get()
 	f()
@@ -157,3 +183,2189 @@ func TestRemove(t *testing.T) {
 		t.Errorf("expected 2 cache fill; got %d", fills)
 	}
 }
+
+func TestSubStore(t *testing.T) {
+	once.Do(testSetup)
+	a := stringStore.(*Store).Sub("tenant-a/")
+	b := stringStore.(*Store).Sub("tenant-b/")
+
+	var s string
+	if err := a.Get("TestSubStore-key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ECHO: tenant-a/TestSubStore-key"; s != want {
+		t.Errorf("got %q; want %q", s, want)
+	}
+
+	b.Set("TestSubStore-key", NewStringView("tenant-b value"))
+	if err := b.Get("TestSubStore-key", StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "tenant-b value"; s != want {
+		t.Errorf("got %q; want %q", s, want)
+	}
+
+	fills := countFills(func() {
+		a.Remove("TestSubStore-key")
+		if err := a.Get("TestSubStore-key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Get("TestSubStore-key", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if fills != 1 {
+		t.Errorf("expected 1 cache fill; got %d", fills)
+	}
+}
+
+func TestKeyedStore(t *testing.T) {
+	once.Do(testSetup)
+	type point struct{ X, Y int }
+	ks := NewKeyedStore(stringStore.(*Store), func(p point) string {
+		return fmt.Sprintf("TestKeyedStore/%d,%d", p.X, p.Y)
+	})
+
+	var s string
+	if err := ks.Get(point{1, 2}, StringSink(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ECHO: TestKeyedStore/1,2"; s != want {
+		t.Errorf("got %q; want %q", s, want)
+	}
+
+	def := NewKeyedStore[point](stringStore.(*Store), nil)
+	if got, want := def.Key(point{1, 2}), "cache.point{X:1, Y:2}"; got != want {
+		t.Errorf("default key = %q; want %q", got, want)
+	}
+}
+
+func TestSizeStats(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	s.Set("a", NewStringView("x"))
+	s.Set("b", NewStringView("xxxxxxxxx"))
+	s.Set("b", NewStringView("xxxxx"))
+
+	st := s.SizeStats()
+	if st.MinValueBytes != 1 || st.MaxValueBytes != 9 || st.AvgValueBytes != 3 {
+		t.Errorf("SizeStats = %+v; want min 1, max 9, avg 3", st)
+	}
+	if got, want := s.CacheStats().Bytes, int64(len("a")+1+len("b")+5); got != want {
+		t.Errorf("CacheStats().Bytes = %d; want %d", got, want)
+	}
+}
+
+func TestMultiGetter(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, MultiGetterFunc(func(key string, dest Sink, set Setter) error {
+		loads.Add(1)
+		set.Set(key+"-sibling", NewStringView("sibling of "+key))
+		return dest.SetString("value of " + key)
+	}))
+
+	var v string
+	if err := s.Get("a", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get("a-sibling", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "sibling of a"; v != want {
+		t.Errorf("got %q; want %q", v, want)
+	}
+	if n := loads.Get(); n != 1 {
+		t.Errorf("getter called %d times; want 1", n)
+	}
+}
+
+func TestCostFunc(t *testing.T) {
+	s := NewUnregisteredStore(3, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}), WithCostFunc(func(key string, value ByteView) int64 {
+		return 1
+	}))
+	for _, key := range []string{"a-long-key", "b-long-key", "c-long-key", "d-long-key"} {
+		s.Set(key, NewStringView(key))
+	}
+	st := s.CacheStats()
+	if st.Items != 3 || st.Bytes != 3 {
+		t.Errorf("CacheStats = %+v; want 3 items costing 3", st)
+	}
+	if _, ok := s.Peek("a-long-key"); ok {
+		t.Error("oldest key not evicted")
+	}
+}
+
+func TestPerEntryOverhead(t *testing.T) {
+	s := NewUnregisteredStore(250, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}), WithPerEntryOverhead(100))
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, NewStringView(key))
+	}
+	st := s.CacheStats()
+	if st.Items != 2 || st.Bytes != 2*(1+1+100) {
+		t.Errorf("CacheStats = %+v; want 2 items costing %d", st, 2*(1+1+100))
+	}
+}
+
+func TestEntryInfo(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("ECHO: " + key)
+	}))
+	if _, ok := s.EntryInfo("TestEntryInfo-key"); ok {
+		t.Fatal("EntryInfo found a key that was never loaded")
+	}
+	for i := 0; i < 3; i++ {
+		var v string
+		if err := s.Get("TestEntryInfo-key", StringSink(&v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, ok := s.EntryInfo("TestEntryInfo-key")
+	if !ok {
+		t.Fatal("EntryInfo did not find a loaded key")
+	}
+	if info.Hits != 2 {
+		t.Errorf("Hits = %d; want 2", info.Hits)
+	}
+	if want := int64(len("ECHO: TestEntryInfo-key")); info.Bytes != want {
+		t.Errorf("Bytes = %d; want %d", info.Bytes, want)
+	}
+	if info.LastAccess.Before(info.LoadedAt) {
+		t.Errorf("LastAccess %v before LoadedAt %v", info.LastAccess, info.LoadedAt)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := NewUnregisteredStore(4, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	var got []string
+	s.Subscribe(func(key string) { got = append(got, key) })
+
+	s.Set("a", NewStringView("1"))
+	s.Set("b", NewStringView("2"))
+	s.Set("c", NewStringView("3"))
+	s.Remove("b")
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notified keys = %q; want %q", got, want)
+	}
+}
+
+type mapSecondary struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (ms *mapSecondary) Get(key string) (ByteView, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	v, ok := ms.m[key]
+	return NewStringView(v), ok, nil
+}
+
+func (ms *mapSecondary) Set(key string, value ByteView) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.m[key] = value.String()
+	return nil
+}
+
+func TestSecondaryStore(t *testing.T) {
+	l2 := &mapSecondary{m: map[string]string{"warm": "from L2"}}
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString("from origin")
+	}), WithSecondaryStore(l2))
+
+	var v string
+	if err := s.Get("warm", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if v != "from L2" || loads.Get() != 0 {
+		t.Errorf("got %q after %d loads; want %q from L2", v, loads.Get(), "from L2")
+	}
+
+	if err := s.Get("cold", StringSink(&v)); err != nil {
+		t.Fatal(err)
+	}
+	if v != "from origin" || loads.Get() != 1 {
+		t.Errorf("got %q after %d loads; want %q after 1 load", v, loads.Get(), "from origin")
+	}
+	if got := l2.m["cold"]; got != "from origin" {
+		t.Errorf("L2 holds %q; want write-through of %q", got, "from origin")
+	}
+	if got := s.Stats.SecondaryHits.Get(); got != 1 {
+		t.Errorf("SecondaryHits = %d; want 1", got)
+	}
+}
+
+func TestDontCache(t *testing.T) {
+	partial := errors.New("partial data")
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		if err := dest.SetString("value of " + key); err != nil {
+			return err
+		}
+		switch key {
+		case "partial":
+			return DontCache(partial)
+		case "uncached":
+			return DontCache(nil)
+		}
+		return nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		var v string
+		if err := s.Get("partial", StringSink(&v)); err != partial {
+			t.Errorf("Get error = %v; want %v", err, partial)
+		}
+		if v != "value of partial" {
+			t.Errorf("got %q; want %q", v, "value of partial")
+		}
+		if err := s.Get("uncached", StringSink(&v)); err != nil {
+			t.Errorf("Get error = %v", err)
+		}
+	}
+	if n := loads.Get(); n != 4 {
+		t.Errorf("getter called %d times; want 4", n)
+	}
+}
+
+func TestAtomicIntCompareAndSwap(t *testing.T) {
+	var i AtomicInt
+	i.Store(5)
+	if i.CompareAndSwap(4, 6) {
+		t.Error("CompareAndSwap(4, 6) succeeded on 5")
+	}
+	if !i.CompareAndSwap(5, 6) {
+		t.Error("CompareAndSwap(5, 6) failed on 5")
+	}
+	if got := i.Get(); got != 6 {
+		t.Errorf("Get = %d; want 6", got)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	for i := 0; i < 3; i++ {
+		var v string
+		if err := s.Get("key", StringSink(&v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.ResetStats()
+	if got := s.Stats.Gets.Get(); got != 0 {
+		t.Errorf("Gets = %d after reset; want 0", got)
+	}
+	st := s.CacheStats()
+	if st.Gets != 0 || st.Hits != 0 {
+		t.Errorf("CacheStats = %+v after reset; want zero gets and hits", st)
+	}
+	if st.Items != 1 || st.Bytes == 0 {
+		t.Errorf("CacheStats = %+v after reset; want live items and bytes kept", st)
+	}
+}
+
+func TestGetBytesAndString(t *testing.T) {
+	once.Do(testSetup)
+	s := stringStore.(*Store)
+	b, err := s.GetBytes("TestGetBytes-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ECHO: TestGetBytes-key"; string(b) != want {
+		t.Errorf("GetBytes = %q; want %q", b, want)
+	}
+	v, err := s.GetString("TestGetBytes-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ECHO: TestGetBytes-key"; v != want {
+		t.Errorf("GetString = %q; want %q", v, want)
+	}
+}
+
+func TestTypedGetSet(t *testing.T) {
+	once.Do(testSetup)
+	s := jsonStore.(*Store)
+	got, err := Get[TestMessage](s, "TestTypedGet-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TestMessage{Name: "ECHO: TestTypedGet-key", City: "SOME-CITY"}); got != want {
+		t.Errorf("Get = %+v; want %+v", got, want)
+	}
+
+	want := TestMessage{Name: "set", City: "OTHER-CITY"}
+	if err := Set(s, "TestTypedSet-key", want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = Get[TestMessage](s, "TestTypedSet-key"); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Get after Set = %+v; want %+v", got, want)
+	}
+}
+
+func TestOffHeapStorage(t *testing.T) {
+	s := NewUnregisteredStore(64, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat(key, 10))
+	}), WithOffHeapStorage())
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			v, err := s.GetString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Repeat(key, 10); v != want {
+				t.Fatalf("got %q; want %q", v, want)
+			}
+		}
+	}
+	if got := s.CacheStats().Bytes; got > 64 {
+		t.Errorf("CacheStats().Bytes = %d; want at most 64", got)
+	}
+}
+
+func TestOffHeapViewOutlivesEviction(t *testing.T) {
+	s := NewUnregisteredStore(64, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat(key, 20))
+	}), WithOffHeapStorage())
+
+	var views []ByteView
+	for i := 0; i < 20; i++ {
+		key := string(rune('a' + i))
+		if _, err := s.GetString(key); err != nil {
+			t.Fatal(err)
+		}
+		v, ok := s.Peek(key)
+		if !ok {
+			t.Fatalf("Peek(%q) missed right after Get", key)
+		}
+		views = append(views, v)
+	}
+	// Most of the entries are evicted and their memory unmapped by now.
+	for i, v := range views {
+		if want := strings.Repeat(string(rune('a'+i)), 20); !v.EqualString(want) {
+			t.Errorf("view %d = %q after eviction; want %q", i, v, want)
+		}
+	}
+}
+
+func TestNewUnregisteredStore(t *testing.T) {
+	getter := GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	})
+	a := NewUnregisteredStore(cacheSize, getter)
+	b := NewUnregisteredStore(cacheSize, getter)
+	if a == b {
+		t.Fatal("NewUnregisteredStore returned the same store twice")
+	}
+	if s := GetStore(""); s != nil {
+		t.Errorf("GetStore(\"\") = %v; want nil", s)
+	}
+	for _, s := range Stores() {
+		if s == a || s == b {
+			t.Error("Stores includes an unregistered store")
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	s := NewUnregisteredStore(1000, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat("x", 10))
+	}), WithShards(4))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := s.GetString(fmt.Sprintf("key-%d-%d", i, j)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	st := s.CacheStats()
+	if st.Bytes > 1000 {
+		t.Errorf("CacheStats().Bytes = %d; want at most 1000", st.Bytes)
+	}
+	if st.Items == 0 || st.Evictions == 0 {
+		t.Errorf("CacheStats = %+v; want items and evictions", st)
+	}
+	if got := s.SizeStats(); got.AvgValueBytes != 10 {
+		t.Errorf("AvgValueBytes = %d; want 10", got.AvgValueBytes)
+	}
+}
+
+func TestLFUPolicy(t *testing.T) {
+	s := NewUnregisteredStore(6, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}), WithEvictionPolicy(PolicyLFU), WithDecayInterval(time.Hour))
+
+	// 0 is read often, so the more recent but once-read 1 goes first.
+	for _, key := range []string{"0", "0", "0", "1", "2", "3"} {
+		if _, err := s.GetString(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := s.Peek("0"); !ok {
+		t.Error("frequently used key 0 was evicted")
+	}
+	if _, ok := s.Peek("1"); ok {
+		t.Error("least frequently used key 1 was not evicted")
+	}
+}
+
+func TestLFUPolicyAdmitsNewHotKey(t *testing.T) {
+	var loads int
+	s := NewUnregisteredStore(6, GetterFunc(func(key string, dest Sink) error {
+		loads++
+		return dest.SetString("v")
+	}), WithEvictionPolicy(PolicyLFU))
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"0", "1", "2"} {
+			if _, err := s.GetString(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	loads = 0
+	for i := 0; i < 5; i++ {
+		if _, err := s.GetString("n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("new key loaded %d times; want 1", loads)
+	}
+	if _, ok := s.Peek("n"); !ok {
+		t.Error("new hot key is not cached")
+	}
+}
+
+func TestClockPolicy(t *testing.T) {
+	s := NewUnregisteredStore(6, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}), WithEvictionPolicy(PolicyClock))
+
+	for _, key := range []string{"0", "1", "2", "0", "3"} {
+		if _, err := s.GetString(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := s.Peek("0"); !ok {
+		t.Error("referenced key 0 was evicted")
+	}
+	if _, ok := s.Peek("1"); ok {
+		t.Error("unreferenced key 1 was not evicted")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := s.GetString(strconv.Itoa((i + j) % 5)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if st := s.CacheStats(); st.Bytes > 6 || st.Hits == 0 {
+		t.Errorf("CacheStats = %+v; want at most 6 bytes and some hits", st)
+	}
+}
+
+func TestLoadIfAbsent(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("ECHO: " + key)
+	}))
+	for i, want := range []bool{true, false} {
+		var v string
+		loaded, err := s.LoadIfAbsent("TestLoadIfAbsent-key", StringSink(&v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded != want {
+			t.Errorf("LoadIfAbsent #%d loaded = %v; want %v", i+1, loaded, want)
+		}
+		if v != "ECHO: TestLoadIfAbsent-key" {
+			t.Errorf("got %q; want %q", v, "ECHO: TestLoadIfAbsent-key")
+		}
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+			return dest.SetString(key)
+		}), WithShards(shards))
+		for i := 0; i < 10; i++ {
+			s.Set(fmt.Sprintf("a/%d", i), NewStringView("x"))
+			s.Set(fmt.Sprintf("b/%d", i), NewStringView("x"))
+		}
+
+		if n := s.RemovePrefix("a/"); n != 10 {
+			t.Errorf("%d shards: RemovePrefix = %d; want 10", shards, n)
+		}
+		s.RemoveAll([]string{"b/0", "b/1", "b/2"})
+
+		st := s.CacheStats()
+		if want := int64(7 * (len("b/0") + 1)); st.Items != 7 || st.Bytes != want {
+			t.Errorf("%d shards: CacheStats = %+v; want 7 items of %d bytes", shards, st, want)
+		}
+		if _, ok := s.Peek("b/3"); !ok {
+			t.Errorf("%d shards: b/3 was removed", shards)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var fills int
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		fills++
+		return dest.SetString("ECHO: " + key)
+	}))
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetString("TestInvalidate-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Invalidate()
+	if _, ok := s.Peek("TestInvalidate-key"); ok {
+		t.Error("Peek found a stale value")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetString("TestInvalidate-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fills != 2 {
+		t.Errorf("expected 2 cache fills; got %d", fills)
+	}
+}
+
+func TestKeyHashing(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString("value of " + key)
+	}), WithKeyHashing(nil))
+
+	long := strings.Repeat("https://example.com/some/long/path/", 10)
+	for i := 0; i < 3; i++ {
+		v, err := s.GetString(long)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "value of " + long; v != want {
+			t.Errorf("got %q; want %q", v, want)
+		}
+	}
+	if n := loads.Get(); n != 1 {
+		t.Errorf("getter called %d times; want 1", n)
+	}
+	if got, want := s.CacheStats().Bytes, int64(16+len("value of ")+len(long)); got != want {
+		t.Errorf("CacheStats().Bytes = %d; want %d", got, want)
+	}
+
+	s.Remove(long)
+	if _, ok := s.Peek(long); ok {
+		t.Error("Peek found a removed key")
+	}
+}
+
+func BenchmarkGetString(b *testing.B) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("value of " + key)
+	}))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetString("key"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	hk := newHotKeys(2)
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		hk.add(key)
+	}
+	want := []KeyStat{{"a", 3}, {"c", 2}}
+	if got := hk.top(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("top(5) = %v; want %v", got, want)
+	}
+	if got := hk.top(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("top(1) = %v; want %v", got, want[:1])
+	}
+}
+
+func TestStoreHotKeys(t *testing.T) {
+	c := make(chan string)
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(<-c)
+	}), WithHotKeyTracking(10))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.GetString("hot")
+		}()
+	}
+	waitForDups(t, s, "hot", 2)
+	c <- "v"
+	wg.Wait()
+
+	want := []KeyStat{{"hot", 2}}
+	if got := s.HotKeys(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("HotKeys = %v; want %v", got, want)
+	}
+	if got := s.HotKeys(-1); got != nil {
+		t.Errorf("HotKeys(-1) = %v; want nil", got)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		t.Errorf("getter called for %q", key)
+		return dest.SetString(key)
+	}))
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.GetOrSet("key", NewStringView(strconv.Itoa(i)), StringSink(&results[i])); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, v := range results {
+		if v != results[0] {
+			t.Fatalf("callers disagree on the value: %q", results)
+		}
+	}
+	if v, _ := s.Peek("key"); v.String() != results[0] {
+		t.Errorf("cached value = %q; want %q", v, results[0])
+	}
+}
+
+func TestKeys(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	for _, key := range []string{"t1/a", "t1/b", "t2/a"} {
+		s.Set(key, NewStringView("x"))
+	}
+	if got, want := s.Keys(), []string{"t2/a", "t1/b", "t1/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys = %q; want %q", got, want)
+	}
+	if got, want := s.Sub("t1/").Keys(), []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sub(%q).Keys = %q; want %q", "t1/", got, want)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}), WithShards(2))
+	var notified int
+	s.Subscribe(func(key string) { notified++ })
+	for i := 0; i < 10; i++ {
+		s.Set(strconv.Itoa(i), NewStringView("x"))
+	}
+	s.Flush()
+
+	if st := s.CacheStats(); st.Items != 0 || st.Bytes != 0 {
+		t.Errorf("CacheStats = %+v after Flush; want no items or bytes", st)
+	}
+	if notified != 10 {
+		t.Errorf("subscribers notified of %d keys; want 10", notified)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	errEmpty := errors.New("empty value")
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		if key == "empty" || key == "serve" {
+			return dest.SetString("{}")
+		}
+		return dest.SetString(`{"Name":"ok"}`)
+	}), WithValidator(func(key string, value ByteView) error {
+		if !value.EqualString("{}") {
+			return nil
+		}
+		if key == "serve" {
+			return DontCache(nil)
+		}
+		return errEmpty
+	}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetString("empty"); err != errEmpty {
+			t.Errorf("Get error = %v; want %v", err, errEmpty)
+		}
+		if v, err := s.GetString("serve"); err != nil || v != "{}" {
+			t.Errorf("Get = %q, %v; want %q, nil", v, err, "{}")
+		}
+		if _, err := s.GetString("ok"); err != nil {
+			t.Errorf("Get error = %v", err)
+		}
+	}
+	if n := loads.Get(); n != 5 {
+		t.Errorf("getter called %d times; want 5", n)
+	}
+}
+
+func TestSaveToLoadFrom(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString("v-" + key)
+	})
+	src := NewUnregisteredStore(cacheSize, getter)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := src.GetString(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := src.SaveTo(&buf); err != nil {
+		t.Fatalf("SaveTo: %v", err)
+	}
+
+	// Only two entries fit, so the least recently used one is dropped.
+	dst := NewUnregisteredStore(2*int64(len("a")+len("v-a")), getter)
+	if err := dst.LoadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadFrom: %v", err)
+	}
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		v, ok := dst.Peek(key)
+		if ok != want {
+			t.Errorf("Peek(%q) ok = %v; want %v", key, ok, want)
+		}
+		if ok && v.String() != "v-"+key {
+			t.Errorf("Peek(%q) = %q; want %q", key, v, "v-"+key)
+		}
+	}
+
+	if err := dst.LoadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Error("LoadFrom of a truncated snapshot succeeded")
+	}
+	if err := dst.LoadFrom(strings.NewReader("not a snapshot")); err == nil {
+		t.Error("LoadFrom of garbage succeeded")
+	}
+}
+
+func TestSaveToLoadFromExpiryAndMeta(t *testing.T) {
+	src := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		SetExpiry(dest, time.Now().Add(30*time.Millisecond))
+		return dest.SetString("v-" + key)
+	}))
+	if _, err := src.GetString("expiring"); err != nil {
+		t.Fatal(err)
+	}
+	src.SetWithMeta("meta", NewStringView("m"), map[string]string{"etag": "x"})
+	var buf bytes.Buffer
+	if err := src.SaveTo(&buf); err != nil {
+		t.Fatalf("SaveTo: %v", err)
+	}
+
+	noLoad := GetterFunc(func(key string, dest Sink) error {
+		return fmt.Errorf("unexpected load of %q", key)
+	})
+	dst := NewUnregisteredStore(cacheSize, noLoad)
+	if err := dst.LoadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadFrom: %v", err)
+	}
+	if _, ok := dst.Peek("expiring"); !ok {
+		t.Error("expiring entry was not restored")
+	}
+	var v string
+	meta, err := dst.GetWithMeta("meta", StringSink(&v))
+	if err != nil || v != "m" || meta["etag"] != "x" {
+		t.Errorf("GetWithMeta = %q, %v, %v; want %q with etag x", v, meta, err, "m")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := dst.Peek("expiring"); ok {
+		t.Error("restored entry outlived its expiry")
+	}
+
+	// Entries that expired between saving and loading are skipped.
+	late := NewUnregisteredStore(cacheSize, noLoad)
+	if err := late.LoadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadFrom: %v", err)
+	}
+	if keys := late.Keys(); !reflect.DeepEqual(keys, []string{"meta"}) {
+		t.Errorf("Keys after a late load = %q; want [meta]", keys)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		if key == "slow" {
+			close(started)
+			<-release
+		}
+		return dest.SetString("v")
+	}), WithMaxInFlight(1))
+
+	done := make(chan error)
+	go func() {
+		_, err := s.GetString("slow")
+		done <- err
+	}()
+	<-started
+	if _, err := s.GetString("other"); err != ErrTooBusy {
+		t.Errorf("Get while busy = %v; want ErrTooBusy", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("slow Get = %v", err)
+	}
+	if _, err := s.GetString("other"); err != nil {
+		t.Errorf("Get after load finished = %v", err)
+	}
+}
+
+func TestGetNoStore(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString("v-" + key)
+	}))
+	var v string
+	for i := 0; i < 2; i++ {
+		if err := s.GetNoStore("scan", StringSink(&v)); err != nil || v != "v-scan" {
+			t.Fatalf("GetNoStore = %q, %v; want %q, nil", v, err, "v-scan")
+		}
+	}
+	if n := loads.Get(); n != 2 {
+		t.Errorf("getter called %d times; want 2", n)
+	}
+	if _, ok := s.Peek("scan"); ok {
+		t.Error("GetNoStore cached its value")
+	}
+
+	if _, err := s.GetString("hot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.GetNoStore("hot", StringSink(&v)); err != nil || v != "v-hot" {
+		t.Errorf("GetNoStore of cached key = %q, %v", v, err)
+	}
+	if n := loads.Get(); n != 3 {
+		t.Errorf("getter called %d times; want 3", n)
+	}
+}
+
+func TestGetChecked(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}))
+	var v string
+	for i, want := range []bool{false, true} {
+		hit, err := s.GetChecked("k", StringSink(&v))
+		if err != nil || v != "v" {
+			t.Fatalf("GetChecked #%d = %q, %v", i, v, err)
+		}
+		if hit != want {
+			t.Errorf("GetChecked #%d hit = %v; want %v", i, hit, want)
+		}
+	}
+	if hit, err := s.GetChecked("k", nil); err == nil || hit {
+		t.Errorf("GetChecked with a nil dest = %v, %v; want false and an error", hit, err)
+	}
+}
+
+func TestExpiredItems(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}))
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.GetString(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Invalidate()
+	if _, err := s.GetString("a"); err != nil {
+		t.Fatal(err)
+	}
+	if items, expired := s.CacheStats().Items, s.ExpiredItems(); items != 2 || expired != 1 {
+		t.Errorf("Items, ExpiredItems = %d, %d; want 2, 1", items, expired)
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	invalid := errors.New("invalid")
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		if key == "bad" {
+			return invalid
+		}
+		return dest.SetString("v")
+	}), WithKeyRateLimit(2, time.Hour), WithValidator(func(key string, value ByteView) error {
+		return DontCache(nil)
+	}))
+
+	for i := 0; i < 4; i++ {
+		if _, err := s.GetString("bad"); err != invalid {
+			t.Errorf("Get(bad) #%d = %v; want %v", i, err, invalid)
+		}
+	}
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if _, err := s.GetString("uncached"); err != want {
+			t.Errorf("Get(uncached) #%d = %v; want %v", i, err, want)
+		}
+	}
+	if n := loads.Get(); n != 4 {
+		t.Errorf("getter called %d times; want 4", n)
+	}
+}
+
+func TestWithBackend(t *testing.T) {
+	var backends int
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v-" + key)
+	}), WithBackend(func(onEvicted func(key string, value interface{})) Backend {
+		backends++
+		return &lru.Cache{OnEvicted: onEvicted}
+	}))
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Peek("k"); !ok || v.String() != "v-k" {
+		t.Errorf("Peek = %q, %v; want %q, true", v, ok, "v-k")
+	}
+	s.Remove("k")
+	if st := s.CacheStats(); st.Items != 0 || st.Bytes != 0 {
+		t.Errorf("after Remove, CacheStats = %+v; want empty", st)
+	}
+	if backends != 1 {
+		t.Errorf("created %d backends; want 1", backends)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString(strings.Repeat("x", 1<<10))
+	})
+	s := NewUnregisteredStore(Unlimited, getter, WithShards(4))
+	for i := 0; i < 100; i++ {
+		if _, err := s.GetString(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.CacheStats(); st.Items != 100 || st.Evictions != 0 {
+		t.Errorf("Items, Evictions = %d, %d; want 100, 0", st.Items, st.Evictions)
+	}
+
+	disabled := NewUnregisteredStore(0, getter)
+	loads.Store(0)
+	for i := 0; i < 2; i++ {
+		if _, err := disabled.GetString("k"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := loads.Get(); n != 2 {
+		t.Errorf("disabled cache: getter called %d times; want 2", n)
+	}
+}
+
+func TestAvailableFullness(t *testing.T) {
+	s := NewUnregisteredStore(100, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	if got := s.Available(); got != 100 {
+		t.Errorf("empty Available = %d; want 100", got)
+	}
+	s.Set("key", NewStringView(strings.Repeat("x", 22)))
+	if got := s.Available(); got != 75 {
+		t.Errorf("Available = %d; want 75", got)
+	}
+	if got := s.Fullness(); got != 0.25 {
+		t.Errorf("Fullness = %v; want 0.25", got)
+	}
+
+	disabled := NewUnregisteredStore(0, s.getter)
+	if a, f := disabled.Available(), disabled.Fullness(); a != 0 || f != 1 {
+		t.Errorf("disabled Available, Fullness = %d, %v; want 0, 1", a, f)
+	}
+}
+
+func TestAdmissionPolicy(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(100, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString(strings.Repeat("x", len(key)*10))
+	}), WithAdmissionPolicy(func(key string, value ByteView, current, limit int64) bool {
+		// Don't let a value take more than half of what's free.
+		return int64(value.Len()) <= (limit-current)/2
+	}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetString("small"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetString("a-larger-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := loads.Get(); n != 3 {
+		t.Errorf("getter called %d times; want 3", n)
+	}
+	if _, ok := s.Peek("a-larger-key"); ok {
+		t.Error("rejected value was cached")
+	}
+
+	var v string
+	if err := s.GetOrSet("a-larger-key", NewStringView(strings.Repeat("x", 100)), StringSink(&v)); err != nil || len(v) != 100 {
+		t.Errorf("GetOrSet = %d bytes, %v; want the value passed", len(v), err)
+	}
+	if _, ok := s.Peek("a-larger-key"); ok {
+		t.Error("value rejected by GetOrSet was cached")
+	}
+	if err := s.GetOrSet("small", NewStringView("other"), StringSink(&v)); err != nil || v != strings.Repeat("x", 50) {
+		t.Errorf("GetOrSet of a cached key = %q, %v; want the cached value", v, err)
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	s := NewUnregisteredStore(3*int64(len("hot0")+10), GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat("x", 10))
+	}), WithAdmission(PolicyTinyLFU))
+
+	hot := []string{"hot0", "hot1", "hot2"}
+	for i := 0; i < 5; i++ {
+		for _, key := range hot {
+			if _, err := s.GetString(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A scan of keys seen once must not push out the hot keys.
+	for i := 0; i < 20; i++ {
+		if _, err := s.GetString(fmt.Sprintf("scan%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range hot {
+		if _, ok := s.Peek(key); !ok {
+			t.Errorf("hot key %q was evicted by a scan", key)
+		}
+	}
+
+	// A key that becomes popular gets in.
+	for i := 0; i < 10; i++ {
+		if _, err := s.GetString("new-hot"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := s.Peek("new-hot"); !ok {
+		t.Error("frequently requested key was never admitted")
+	}
+}
+
+func TestOnLoadError(t *testing.T) {
+	broken := errors.New("broken")
+	var failed []string
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		if strings.HasPrefix(key, "bad") {
+			return broken
+		}
+		return dest.SetString("v")
+	}), WithOnLoadError(func(key string, err error) {
+		if err != broken {
+			t.Errorf("hook got error %v; want %v", err, broken)
+		}
+		failed = append(failed, key)
+	}))
+	for _, key := range []string{"bad1", "good", "bad2"} {
+		s.GetString(key)
+	}
+	if want := []string{"bad1", "bad2"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed keys = %v; want %v", failed, want)
+	}
+	if n := s.Stats.LocalLoadErrs.Get(); n != 2 {
+		t.Errorf("LocalLoadErrs = %d; want 2", n)
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	down := errors.New("down")
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		if key == "missing" {
+			return down
+		}
+		return dest.SetString("v-" + key)
+	}))
+	def := NewStringView("default")
+	for key, want := range map[string]string{"missing": "default", "k": "v-k"} {
+		var v string
+		if err := s.GetOrDefault(key, StringSink(&v), def); err != nil || v != want {
+			t.Errorf("GetOrDefault(%q) = %q, %v; want %q, nil", key, v, err, want)
+		}
+	}
+	if _, ok := s.Peek("missing"); ok {
+		t.Error("default value was cached")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads.Add(1)
+		return dest.SetString("v")
+	}))
+	if s.Touch("k", time.Hour) {
+		t.Error("Touch of an absent key reported success")
+	}
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Touch("k", time.Hour) {
+		t.Fatal("Touch of a cached key failed")
+	}
+	if info, _ := s.EntryInfo("k"); info.Expires.IsZero() {
+		t.Error("EntryInfo.Expires not set by Touch")
+	}
+	if !s.Touch("k", time.Nanosecond) {
+		t.Fatal("Touch of a cached key failed")
+	}
+	time.Sleep(time.Millisecond)
+	if _, ok := s.Peek("k"); ok {
+		t.Error("expired value still cached")
+	}
+	if n := s.ExpiredItems(); n != 1 {
+		t.Errorf("ExpiredItems = %d; want 1", n)
+	}
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	if n := loads.Get(); n != 2 {
+		t.Errorf("getter called %d times; want 2", n)
+	}
+}
+
+func TestGetFresh(t *testing.T) {
+	var loads AtomicInt
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strconv.FormatInt(loads.Get(), 10))
+	}))
+	bump := func() { loads.Add(1) }
+	var v string
+	if err := s.Get("k", StringSink(&v)); err != nil || v != "0" {
+		t.Fatalf("Get = %q, %v; want 0", v, err)
+	}
+	bump()
+	if err := s.GetFresh("k", StringSink(&v), time.Hour); err != nil || v != "0" {
+		t.Errorf("GetFresh within maxAge = %q, %v; want cached 0", v, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := s.GetFresh("k", StringSink(&v), time.Millisecond); err != nil || v != "1" {
+		t.Errorf("GetFresh past maxAge = %q, %v; want reloaded 1", v, err)
+	}
+	bump()
+	if err := s.Get("k", StringSink(&v)); err != nil || v != "1" {
+		t.Errorf("Get after GetFresh = %q, %v; want cached 1", v, err)
+	}
+}
+
+// tryNewStoreRuns counts the runs of TestTryNewStore, so that each
+// registers a new name when tests are run more than once.
+var tryNewStoreRuns int
+
+func TestTryNewStore(t *testing.T) {
+	getter := GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	})
+	tryNewStoreRuns++
+	name := "try-new-store-" + strconv.Itoa(tryNewStoreRuns)
+	s, err := TryNewStore(name, cacheSize, getter)
+	if err != nil || s == nil {
+		t.Fatalf("TryNewStore = %v, %v; want a store", s, err)
+	}
+	if dup, err := TryNewStore(name, cacheSize, getter); err != ErrStoreExists || dup != nil {
+		t.Errorf("duplicate TryNewStore = %v, %v; want nil, ErrStoreExists", dup, err)
+	}
+	if got := GetStore(name); got != s {
+		t.Errorf("GetStore = %v; want the first store", got)
+	}
+}
+
+func TestGetWithMetadata(t *testing.T) {
+	release := make(chan struct{})
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		if key == "slow" {
+			<-release
+		}
+		return dest.SetString("v")
+	}))
+	var v string
+	meta, err := s.GetWithMetadata("k", StringSink(&v))
+	if err != nil || meta.Source != SourceGetter || meta.Shared || meta.LoadDuration <= 0 {
+		t.Errorf("first Get meta = %+v, %v; want fresh getter load", meta, err)
+	}
+	meta, err = s.GetWithMetadata("k", StringSink(&v))
+	if err != nil || meta != (Meta{Source: SourceCache}) {
+		t.Errorf("second Get meta = %+v, %v; want cache hit", meta, err)
+	}
+
+	metas := make(chan Meta, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var v string
+			meta, _ := s.GetWithMetadata("slow", StringSink(&v))
+			metas <- meta
+		}()
+	}
+	waitForDups(t, s, "slow", 1)
+	close(release)
+	var shared int
+	for i := 0; i < 2; i++ {
+		if meta := <-metas; meta.Source != SourceGetter {
+			t.Errorf("concurrent Get source = %v; want SourceGetter", meta.Source)
+		} else if meta.Shared {
+			shared++
+		}
+	}
+	if shared != 1 {
+		t.Errorf("%d concurrent Gets shared a load; want 1", shared)
+	}
+}
+
+func TestSetWithMeta(t *testing.T) {
+	s := NewUnregisteredStore(1<<20, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("loaded")
+	}))
+	meta := map[string]string{"content-type": "text/plain", "etag": "abc"}
+	s.SetWithMeta("k", NewStringView("body"), meta)
+	meta["etag"] = "changed"
+	if got, want := s.cache.bytes(), int64(len("k")+len("body")+len("content-typetext/plainetagabc")); got != want {
+		t.Errorf("bytes = %d; want %d", got, want)
+	}
+
+	var v string
+	got, err := s.GetWithMeta("k", StringSink(&v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "body" || got["content-type"] != "text/plain" || got["etag"] != "abc" {
+		t.Errorf("GetWithMeta = %q, %v", v, got)
+	}
+	got["etag"] = "mutated"
+	if again, _ := s.GetWithMeta("k", StringSink(&v)); again["etag"] != "abc" {
+		t.Errorf("stored metadata was modified: %v", again)
+	}
+
+	got, err = s.GetWithMeta("other", StringSink(&v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "loaded" || got != nil {
+		t.Errorf("loaded GetWithMeta = %q, %v; want nil metadata", v, got)
+	}
+
+	s.Remove("k")
+	if got, want := s.cache.bytes(), int64(len("other")+len("loaded")); got != want {
+		t.Errorf("bytes after Remove = %d; want %d", got, want)
+	}
+}
+
+func TestConcurrentSetsStayWithinBudget(t *testing.T) {
+	const budget = 1000
+	s := NewUnregisteredStore(budget, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("unused")
+	}))
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	over := make(chan int64, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(over)
+				return
+			default:
+			}
+			if n := s.cache.bytes(); n > budget {
+				select {
+				case over <- n:
+				default:
+				}
+			}
+			runtime.Gosched()
+		}
+	}()
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Set(fmt.Sprintf("%d-%d", g, i), NewStringView("0123456789"))
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	if n, ok := <-over; ok {
+		t.Errorf("cache held %d bytes; budget is %d", n, budget)
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	loads := 0
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads++
+		return dest.SetString("loaded")
+	}))
+	var v string
+	if s.GetStale("k", StringSink(&v)) {
+		t.Error("GetStale found an uncached key")
+	}
+	s.Set("k", NewStringView("cached"))
+	if !s.GetStale("k", StringSink(&v)) || v != "cached" {
+		t.Errorf("GetStale = %q; want %q", v, "cached")
+	}
+	if loads != 0 {
+		t.Errorf("getter called %d times", loads)
+	}
+	if got := s.Stats.StaleGets.Get(); got != 2 {
+		t.Errorf("StaleGets = %d; want 2", got)
+	}
+	if got := s.Stats.Gets.Get() + s.CacheStats().Gets; got != 0 {
+		t.Errorf("GetStale counted %d Gets", got)
+	}
+}
+
+func TestPin(t *testing.T) {
+	s := NewUnregisteredStore(100, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("0123456789")
+	}))
+	s.Set("config", NewStringView("pinned"))
+	if !s.Pin("config") {
+		t.Fatal("Pin failed")
+	}
+	if s.Pin("missing") {
+		t.Error("Pin succeeded for an uncached key")
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := s.GetString(fmt.Sprintf("k%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ok := s.Peek("config"); !ok || v.String() != "pinned" {
+		t.Error("pinned value was evicted")
+	}
+	if got := s.cache.bytes(); got > 100 {
+		t.Errorf("cache holds %d bytes; budget is 100", got)
+	}
+
+	// A new value for a pinned key stays pinned.
+	s.Set("config", NewStringView("updated"))
+	for i := 20; i < 40; i++ {
+		s.GetString(fmt.Sprintf("k%02d", i))
+	}
+	if v, ok := s.Peek("config"); !ok || v.String() != "updated" {
+		t.Error("updated pinned value was evicted")
+	}
+
+	if !s.Unpin("config") || s.Unpin("config") {
+		t.Error("Unpin didn't report the pinned value once")
+	}
+	for i := 40; i < 60; i++ {
+		s.GetString(fmt.Sprintf("k%02d", i))
+	}
+	if _, ok := s.Peek("config"); ok {
+		t.Error("unpinned value was not evicted")
+	}
+
+	s.Set("big", NewStringView(strings.Repeat("x", 60)))
+	if s.Pin("big") {
+		t.Error("Pin exceeded the pinned bytes cap")
+	}
+
+	s.Set("config", NewStringView("pinned"))
+	s.Pin("config")
+	s.Flush()
+	if got := s.cache.bytes(); got != 0 {
+		t.Errorf("cache holds %d bytes after Flush", got)
+	}
+}
+
+func TestHighWatermark(t *testing.T) {
+	var fired []CacheStats
+	s := NewUnregisteredStore(100, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(strings.Repeat("x", 18))
+	}), WithHighWatermark(0.5, func(stats CacheStats) {
+		fired = append(fired, stats)
+	}))
+	for i := 0; i < 4; i++ {
+		s.GetString(fmt.Sprintf("k%d", i))
+	}
+	if len(fired) != 1 {
+		t.Fatalf("callback fired %d times; want once", len(fired))
+	}
+	if fired[0].Bytes != 60 {
+		t.Errorf("stats.Bytes = %d; want 60", fired[0].Bytes)
+	}
+
+	s.Flush()
+	s.GetString("a")
+	if len(fired) != 1 {
+		t.Errorf("callback fired below the watermark")
+	}
+	s.GetString("b")
+	s.GetString("c")
+	if len(fired) != 2 {
+		t.Errorf("callback fired %d times after crossing again; want 2", len(fired))
+	}
+}
+
+func TestFlightStats(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}))
+	s.GetString("a")
+	s.GetString("a")
+	// The second Get is served by the cache without a flight.
+	if got, want := s.FlightStats(), (singleflight.Stats{Calls: 1}); got != want {
+		t.Errorf("FlightStats = %+v; want %+v", got, want)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	type evicted struct {
+		key, value string
+		reason     EvictReason
+	}
+	var got []evicted
+	s := NewUnregisteredStore(30, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("val-" + key)
+	}), WithOnEvict(func(key string, value ByteView, reason EvictReason) {
+		got = append(got, evicted{key, value.String(), reason})
+	}))
+	check := func(what string, want ...evicted) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: evicted %v; want %v", what, got, want)
+		}
+		got = nil
+	}
+
+	s.GetString("a")
+	s.GetString("b")
+	s.GetString("c") // 3 entries of 6 bytes.
+	check("under budget")
+	s.Set("a", NewStringView("replaced"))
+	check("replacement")
+
+	s.GetString("d")
+	s.GetString("e")
+	check("over budget", evicted{"b", "val-b", EvictCapacity})
+
+	s.Remove("c")
+	s.Remove("missing")
+	check("Remove", evicted{"c", "val-c", EvictRemoved})
+
+	s.Touch("a", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	s.GetString("f")
+	s.GetString("g")
+	check("expired", evicted{"a", "replaced", EvictExpired})
+
+	s.RemovePrefix("e")
+	check("RemovePrefix", evicted{"e", "val-e", EvictRemoved})
+
+	s.Flush()
+	if len(got) != 3 {
+		t.Errorf("Flush: evicted %v; want d, f and g", got)
+	}
+	for _, ev := range got {
+		if ev.reason != EvictFlushed {
+			t.Errorf("Flush: evicted %v for %v", ev.key, ev.reason)
+		}
+	}
+	if EvictExpired.String() != "expired" {
+		t.Errorf("String = %q", EvictExpired.String())
+	}
+}
+
+func TestGetManyDeduped(t *testing.T) {
+	var loads []string
+	fail := errors.New("fail")
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads = append(loads, key)
+		if key == "bad" {
+			return fail
+		}
+		return dest.SetString("val-" + key)
+	}))
+	keys := []string{"a", "b", "a", "bad", "a", "bad"}
+	vals := make([]string, len(keys))
+	dests := make([]Sink, len(keys))
+	for i := range dests {
+		dests[i] = StringSink(&vals[i])
+	}
+	errs := s.GetManyDeduped(keys, dests)
+	for i, key := range keys {
+		if key == "bad" {
+			if errs[i] != fail {
+				t.Errorf("error #%d = %v; want %v", i, errs[i], fail)
+			}
+			continue
+		}
+		if errs[i] != nil || vals[i] != "val-"+key {
+			t.Errorf("value #%d = %q, %v; want %q", i, vals[i], errs[i], "val-"+key)
+		}
+	}
+	if want := []string{"a", "b", "bad"}; !reflect.DeepEqual(loads, want) {
+		t.Errorf("loaded %v; want %v", loads, want)
+	}
+	if got := s.Stats.Gets.Get(); got != 3 {
+		t.Errorf("Gets = %d; want 3", got)
+	}
+
+	var v string
+	errs = s.GetManyDeduped([]string{"a", "a"}, []Sink{StringSink(&v), nil})
+	if errs[0] != nil || errs[1] == nil {
+		t.Errorf("GetManyDeduped with a nil dest for a repeated key = %v; want an error for it alone", errs)
+	}
+}
+
+func TestSetExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	loads := 0
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads++
+		if key == "expired" {
+			SetExpiry(dest, time.Now().Add(-time.Second))
+		} else if !SetExpiry(dest, exp) {
+			t.Error("SetExpiry rejected the getter's dest")
+		}
+		return dest.SetString("token")
+	}))
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := s.EntryInfo("k"); !ok || !info.Expires.Equal(exp) {
+		t.Errorf("Expires = %v, %v; want %v", info.Expires, ok, exp)
+	}
+
+	for i := 0; i < 2; i++ {
+		if v, err := s.GetString("expired"); err != nil || v != "token" {
+			t.Errorf("Get(expired) = %q, %v", v, err)
+		}
+	}
+	if loads != 3 {
+		t.Errorf("loads = %d; want 3, as expired values are not cached", loads)
+	}
+
+	var v string
+	if SetExpiry(StringSink(&v), exp) {
+		t.Error("SetExpiry accepted a sink outside a load")
+	}
+}
+
+type brokenSecondary struct{}
+
+func (brokenSecondary) Get(key string) (ByteView, bool, error) {
+	return ByteView{}, false, errors.New("l2 down")
+}
+
+func (brokenSecondary) Set(key string, value ByteView) error {
+	return errors.New("l2 down")
+}
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestWithLogger(t *testing.T) {
+	l := new(testLogger)
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}), WithSecondaryStore(brokenSecondary{}), WithLogger(l))
+	if _, err := s.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`cache: store "": secondary get "k": l2 down`,
+		`cache: store "": secondary set "k": l2 down`,
+	}
+	if !reflect.DeepEqual(l.lines, want) {
+		t.Errorf("logged %q; want %q", l.lines, want)
+	}
+
+	// Without WithLogger, nothing is logged and nothing breaks.
+	quiet := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("v")
+	}), WithSecondaryStore(brokenSecondary{}))
+	if _, err := quiet.GetString("k"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return errors.New("not loaded")
+	}))
+	incr := func(old ByteView, existed bool) (ByteView, bool, error) {
+		n := 0
+		if existed {
+			n, _ = strconv.Atoi(old.String())
+		}
+		return NewStringView(strconv.Itoa(n + 1)), true, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Update("counter", incr); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := s.Peek("counter"); v.String() != "50" {
+		t.Errorf("counter = %q; want 50", v.String())
+	}
+
+	fail := errors.New("fail")
+	if err := s.Update("counter", func(ByteView, bool) (ByteView, bool, error) {
+		return ByteView{}, false, fail
+	}); err != fail {
+		t.Errorf("Update error = %v; want %v", err, fail)
+	}
+	if _, ok := s.Peek("counter"); !ok {
+		t.Error("failed Update changed the cache")
+	}
+	s.Update("counter", func(ByteView, bool) (ByteView, bool, error) {
+		return ByteView{}, false, nil
+	})
+	if _, ok := s.Peek("counter"); ok {
+		t.Error("Update didn't remove the value")
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("session")
+	}), WithSlidingTTL(ttl))
+	s.Set("sid", NewStringView("session"))
+	s.Set("idle", NewStringView("session"))
+	var v string
+	for deadline := time.Now().Add(3 * ttl); time.Now().Before(deadline); {
+		if hit, err := s.GetChecked("sid", StringSink(&v)); err != nil || !hit {
+			t.Fatalf("GetChecked = %v, %v; want a hit while in use", hit, err)
+		}
+		time.Sleep(ttl / 5)
+	}
+	if _, ok := s.Peek("idle"); ok {
+		t.Error("idle value did not expire")
+	}
+	time.Sleep(ttl + ttl/2)
+	if _, ok := s.Peek("sid"); ok {
+		t.Error("value did not expire once idle")
+	}
+}
+
+func TestSlidingTTLTouch(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("reloaded")
+	}), WithSlidingTTL(ttl))
+	s.Set("forever", NewStringView("v"))
+	s.Set("long", NewStringView("v"))
+	s.Touch("forever", 0)
+	s.Touch("long", 10*ttl)
+	var v string
+	for _, key := range []string{"forever", "long"} {
+		if err := s.Get(key, StringSink(&v)); err != nil || v != "v" {
+			t.Fatalf("Get(%q) = %q, %v", key, v, err)
+		}
+	}
+	time.Sleep(3 * ttl)
+	for _, key := range []string{"forever", "long"} {
+		if _, ok := s.Peek(key); !ok {
+			t.Errorf("%q expired within the sliding window after Touch", key)
+		}
+	}
+	if info, _ := s.EntryInfo("forever"); !info.Expires.IsZero() {
+		t.Errorf("Touch(0) entry expires at %v; want never", info.Expires)
+	}
+}
+
+// lruOrder returns the keys cached by s, which must use a single LRU
+// shard, in the order they would be evicted.
+func lruOrder(t testing.TB, s *Store) []string {
+	t.Helper()
+	c := singleShard(t, s)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l, ok := c.ev.(*lru.Cache)
+	if !ok {
+		t.Fatalf("backend is %T; want *lru.Cache", c.ev)
+	}
+	var keys []string
+	l.Each(func(key string, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return keys
+}
+
+// evictOldest makes s, which must use a single shard, evict its n
+// oldest entries as if for room, whatever their size, and returns
+// their keys.
+func evictOldest(t testing.TB, s *Store, n int) []string {
+	t.Helper()
+	c := singleShard(t, s)
+	c.mu.Lock()
+	for i := 0; i < n; i++ {
+		if _, _, ok := c.ev.RemoveOldest(); !ok {
+			break
+		}
+	}
+	evs := c.takeEvictionsLocked()
+	c.mu.Unlock()
+	s.notifyEvicted(evs)
+	keys := make([]string, len(evs))
+	for i, ev := range evs {
+		keys[i] = ev.key
+	}
+	return keys
+}
+
+func singleShard(t testing.TB, s *Store) *cache {
+	t.Helper()
+	if len(s.cache.shards) != 1 {
+		t.Fatalf("store has %d shards; want 1", len(s.cache.shards))
+	}
+	c := s.cache.shards[0]
+	c.mu.Lock()
+	if c.ev == nil {
+		c.ev = c.newEvictor()
+	}
+	c.mu.Unlock()
+	return c
+}
+
+func TestEvictionOrder(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		s.GetString(key)
+	}
+	s.GetString("b")
+	s.Peek("a")
+	if got, want := lruOrder(t, s), []string{"a", "c", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q; want %q", got, want)
+	}
+
+	var notified []string
+	s.Subscribe(func(key string) { notified = append(notified, key) })
+	if got, want := evictOldest(t, s, 2), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("evicted %q; want %q", got, want)
+	}
+	if got, want := lruOrder(t, s), []string{"d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order after eviction = %q; want %q", got, want)
+	}
+	if !reflect.DeepEqual(notified, []string{"a", "c"}) {
+		t.Errorf("notified %q", notified)
+	}
+	if got := s.CacheStats().Evictions; got != 2 {
+		t.Errorf("Evictions = %d; want 2", got)
+	}
+}
+
+func TestWithShardHasher(t *testing.T) {
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}), WithShards(4), WithShardHasher(func(key string) uint64 {
+		return uint64(key[len(key)-1] - '0')
+	}))
+	for i := 0; i < 8; i++ {
+		s.GetString(fmt.Sprintf("/a/long/shared/path/%d", i))
+	}
+	for i, c := range s.cache.shards {
+		if got := c.items(); got != 2 {
+			t.Errorf("shard %d holds %d items; want 2", i, got)
+		}
+	}
+	if c := s.cache.shard("/x/3"); c != s.cache.shards[3] {
+		t.Error("key not in the shard picked by the hasher")
+	}
+}
+
+type memLocker struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (l *memLocker) Lock(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[key] {
+		return nil, false
+	}
+	l.held[key] = true
+	return func() {
+		l.mu.Lock()
+		delete(l.held, key)
+		l.mu.Unlock()
+	}, true
+}
+
+func TestDistributedLocker(t *testing.T) {
+	l2 := &mapSecondary{m: map[string]string{}}
+	locker := &memLocker{held: map[string]bool{}}
+	var loads int32
+	newNode := func() *Store {
+		return NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+			atomic.AddInt32(&loads, 1)
+			locker.mu.Lock()
+			held := locker.held[key]
+			locker.mu.Unlock()
+			if !held {
+				t.Error("getter ran without the lock")
+			}
+			return dest.SetString("loaded " + key)
+		}), WithSecondaryStore(l2), WithDistributedLocker(locker, time.Second))
+	}
+
+	// A peer holds the lock and publishes the value to the shared tier.
+	unlock, _ := locker.Lock("cold")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l2.Set("cold", NewStringView("from peer"))
+		unlock()
+	}()
+	if v, err := newNode().GetString("cold"); err != nil || v != "from peer" {
+		t.Errorf("Get while a peer loads = %q, %v; want %q", v, err, "from peer")
+	}
+	if n := atomic.LoadInt32(&loads); n != 0 {
+		t.Errorf("getter ran %d times while a peer loaded", n)
+	}
+
+	// With the lock free, a node loads the value and releases it.
+	if v, err := newNode().GetString("free"); err != nil || v != "loaded free" {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if v, _, _ := l2.Get("free"); v.String() != "loaded free" {
+		t.Errorf("secondary holds %q", v.String())
+	}
+	if _, ok := locker.Lock("free"); !ok {
+		t.Error("lock was not released")
+	}
+
+	// A peer that holds the lock but never publishes delays the load by
+	// the wait only.
+	locker.Lock("stuck")
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString("fallback")
+	}), WithSecondaryStore(l2), WithDistributedLocker(locker, 10*time.Millisecond))
+	if v, err := s.GetString("stuck"); err != nil || v != "fallback" {
+		t.Errorf("Get with a stuck peer = %q, %v", v, err)
+	}
+}
+
+func TestGetterDidNotPopulate(t *testing.T) {
+	var loads int
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loads++
+		if key == "empty" {
+			return dest.SetString("")
+		}
+		return nil
+	}))
+	var v string
+	for i := 0; i < 2; i++ {
+		if err := s.Get("forgot", StringSink(&v)); !errors.Is(err, ErrGetterDidNotPopulate) {
+			t.Fatalf("Get = %v; want ErrGetterDidNotPopulate", err)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("getter ran %d times; want 2, as nothing should be cached", loads)
+	}
+	if err := s.Get("empty", StringSink(&v)); err != nil || v != "" {
+		t.Errorf("Get of an empty value = %q, %v", v, err)
+	}
+	if cached, ok := s.Peek("empty"); !ok || cached.IsZero() {
+		t.Errorf("Peek of an empty value = %v, IsZero %v; want a non-zero view", ok, cached.IsZero())
+	}
+}
+
+func TestWithFlightStore(t *testing.T) {
+	fs := &singleflight.Store{}
+	started, release := make(chan bool), make(chan bool)
+	a := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		started <- true
+		<-release
+		return dest.SetString("from a")
+	}), WithFlightStore(fs))
+	b := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		t.Error("b's getter ran for a key a was loading")
+		return dest.SetString("from b")
+	}), WithFlightStore(fs))
+
+	errc := make(chan error)
+	go func() {
+		_, err := a.GetString("k")
+		errc <- err
+	}()
+	<-started
+	go func() {
+		v, err := b.GetString("k")
+		if err == nil && v != "from a" {
+			err = fmt.Errorf("b got %q", v)
+		}
+		errc <- err
+	}()
+	for fs.Stats().Deduped == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if _, ok := b.Peek("k"); !ok {
+		t.Error("value loaded by a was not cached in b")
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	// Every counter in Stats must be in StatsSnapshot.
+	st, sn := reflect.TypeOf(Stats{}), reflect.TypeOf(StatsSnapshot{})
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.Type != reflect.TypeOf(AtomicInt(0)) {
+			continue
+		}
+		if _, ok := sn.FieldByName(f.Name); !ok {
+			t.Errorf("StatsSnapshot lacks Stats field %s", f.Name)
+		}
+	}
+
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		return dest.SetString(key)
+	}))
+	s.GetString("a")
+	before := s.Snapshot()
+	s.GetString("a")
+	s.GetString("b")
+	d := s.Snapshot().Sub(before)
+	want := StatsSnapshot{Gets: 2, CacheHits: 1, Loads: 1, LoadsDeduped: 1, LocalLoads: 1}
+	if d != want {
+		t.Errorf("delta = %+v; want %+v", d, want)
+	}
+}
+
+func TestWithSingleflightDisabled(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		started <- true
+		<-release
+		return dest.SetString(key)
+	}), WithSingleflight(false))
+	errc := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := s.GetString("k")
+			errc <- err
+		}()
+	}
+	// Both Gets reach the getter, which they would not if the second
+	// joined the first's load.
+	<-started
+	<-started
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := s.Stats.LoadsDeduped.Get(); n != 0 {
+		t.Errorf("LoadsDeduped = %d; want 0", n)
+	}
+}
+
+func TestWithKeyNormalizer(t *testing.T) {
+	var loaded []string
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loaded = append(loaded, key)
+		return dest.SetString("v" + key)
+	}), WithKeyNormalizer(func(key string) string {
+		return strings.TrimSuffix(strings.ToLower(key), "/")
+	}))
+	for _, key := range []string{"/a", "/a/", "/A", "/A/"} {
+		if v, err := s.GetString(key); err != nil || v != "v/a" {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, v, err, "v/a")
+		}
+	}
+	if want := []string{"/a"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("getter loaded %q; want %q", loaded, want)
+	}
+
+	s.Set("/B/", NewStringView("b"))
+	if v, ok := s.Peek("/b"); !ok || v.String() != "b" {
+		t.Errorf("Peek(/b) = %q, %v after Set(/B/)", v.String(), ok)
+	}
+	s.Remove("/a/")
+	if _, ok := s.Peek("/a"); ok {
+		t.Error("Remove(/a/) left /a cached")
+	}
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"/b"}) {
+		t.Errorf("Keys = %q; want [/b]", keys)
+	}
+}
+
+func TestGetDeduped(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		started <- true
+		<-release
+		return dest.SetString(key)
+	}))
+	type result struct {
+		deduped bool
+		err     error
+	}
+	results := make(chan result)
+	get := func() {
+		var v string
+		deduped, err := s.GetDeduped("k", StringSink(&v))
+		results <- result{deduped, err}
+	}
+	go get()
+	<-started
+	go get()
+	for s.FlightStats().Deduped == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	var shared int
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.deduped {
+			shared++
+		}
+	}
+	if shared != 1 {
+		t.Errorf("%d Gets deduped; want 1", shared)
+	}
+	var v string
+	if deduped, err := s.GetDeduped("k", StringSink(&v)); err != nil || deduped {
+		t.Errorf("GetDeduped of a cached key = %v, %v; want false, nil", deduped, err)
+	}
+}
+
+func TestSweepLoads(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	l := new(testLogger)
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		if key == "hung" {
+			<-hung
+		}
+		return dest.SetString("v")
+	}), WithLogger(l))
+	go s.GetString("hung")
+	for s.PendingLoads() == 0 {
+		runtime.Gosched()
+	}
+	if n := s.SweepLoads(time.Hour); n != 0 {
+		t.Errorf("SweepLoads(time.Hour) = %d; want 0", n)
+	}
+	swept := 0
+	for swept == 0 {
+		swept = s.SweepLoads(time.Millisecond)
+		runtime.Gosched()
+	}
+	if swept != 1 || s.PendingLoads() != 0 || s.Stats.LoadsSwept.Get() != 1 {
+		t.Errorf("SweepLoads = %d, leaving %d pending, LoadsSwept %d; want 1, 0, 1",
+			swept, s.PendingLoads(), s.Stats.LoadsSwept.Get())
+	}
+	l.mu.Lock()
+	if len(l.lines) != 1 || !strings.Contains(l.lines[0], "swept 1 loads") {
+		t.Errorf("logged %q; want the sweep", l.lines)
+	}
+	l.mu.Unlock()
+}
+
+func TestKeyNormalizerAppliedOnce(t *testing.T) {
+	var loaded []string
+	s := NewUnregisteredStore(cacheSize, GetterFunc(func(key string, dest Sink) error {
+		loaded = append(loaded, key)
+		return dest.SetString("v")
+	}), WithKeyNormalizer(func(key string) string { return "n:" + key }))
+	errs := s.GetManyDeduped([]string{"a", "a"}, []Sink{StringSink(new(string)), StringSink(new(string))})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	if want := []string{"n:a"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("getter loaded %q; want %q", loaded, want)
+	}
+	err := s.Update("c", func(old ByteView, existed bool) (ByteView, bool, error) {
+		return NewStringView("1"), true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := s.Keys()
+	sort.Strings(keys)
+	if want := []string{"n:a", "n:c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys = %q; want %q", keys, want)
+	}
+}
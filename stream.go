@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/FeiniuBus/cache/lru"
+	"github.com/FeiniuBus/cache/singleflight"
+)
+
+// A StreamGetter loads data for a key by writing it to w.
+type StreamGetter interface {
+	GetStream(key string, w io.Writer) error
+}
+
+// A StreamGetterFunc implements StreamGetter with a function.
+type StreamGetterFunc func(key string, w io.Writer) error
+
+func (f StreamGetterFunc) GetStream(key string, w io.Writer) error {
+	return f(key, w)
+}
+
+// A StreamStore caches values too large to hold in memory. Each value
+// is written by the getter to a file in the store's directory, and the
+// files are evicted in LRU order once their total size exceeds the
+// store's cacheBytes. Evicting a value deletes its file.
+type StreamStore struct {
+	// loadStore is first so that its atomic counters are 8-byte
+	// aligned on 32-bit platforms.
+	loadStore singleflight.Store
+
+	dir        string
+	getter     StreamGetter
+	cacheBytes int64
+
+	mu     sync.Mutex
+	nbytes int64
+	lru    *lru.Cache
+}
+
+type streamEntry struct {
+	path string
+	size int64
+}
+
+// NewStreamStore creates a StreamStore keeping its files in dir, which
+// must exist.
+func NewStreamStore(dir string, cacheBytes int64, getter StreamGetter) *StreamStore {
+	if getter == nil {
+		panic("nil StreamGetter")
+	}
+	s := &StreamStore{
+		dir:        dir,
+		getter:     getter,
+		cacheBytes: cacheBytes,
+	}
+	s.lru = &lru.Cache{
+		OnEvicted: func(key string, value interface{}) {
+			e := value.(*streamEntry)
+			s.nbytes -= e.size
+			os.Remove(e.path)
+		},
+	}
+	return s
+}
+
+// A ByteStream reads a value cached by a StreamStore. It must be
+// closed after use. A ByteStream stays readable after its value is
+// evicted on systems that allow reading deleted files.
+type ByteStream struct {
+	f    *os.File
+	size int64
+}
+
+// Len returns the length of the value.
+func (b *ByteStream) Len() int64 {
+	return b.size
+}
+
+// Read implements io.Reader.
+func (b *ByteStream) Read(p []byte) (int, error) {
+	return b.f.Read(p)
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *ByteStream) ReadAt(p []byte, off int64) (int, error) {
+	return b.f.ReadAt(p, off)
+}
+
+// Close releases the stream's file.
+func (b *ByteStream) Close() error {
+	return b.f.Close()
+}
+
+// Get returns a stream of the value for key, loading it with the
+// getter if it is not cached.
+func (s *StreamStore) Get(key string) (*ByteStream, error) {
+	if b, ok, err := s.open(key); ok || err != nil {
+		return b, err
+	}
+	_, err := s.loadStore.Do(key, func() (interface{}, error) {
+		s.mu.Lock()
+		_, cached := s.lru.Peek(key)
+		s.mu.Unlock()
+		if cached {
+			return nil, nil
+		}
+		return nil, s.load(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, ok, err := s.open(key)
+	if !ok && err == nil {
+		err = errors.New("stream: value evicted before it could be read")
+	}
+	return b, err
+}
+
+// open opens the cached file for key. The file is opened under the
+// lock so that it can't be evicted between lookup and open.
+func (s *StreamStore) open(key string) (b *ByteStream, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vi, ok := s.lru.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	e := vi.(*streamEntry)
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, true, err
+	}
+	return &ByteStream{f: f, size: e.size}, true, nil
+}
+
+func (s *StreamStore) load(key string) error {
+	f, err := os.CreateTemp(s.dir, "stream-")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	err = s.getter.GetStream(key, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Remove(key)
+	s.lru.Add(key, &streamEntry{path: path, size: fi.Size()})
+	s.nbytes += fi.Size()
+	// The newest value is kept even if it alone exceeds cacheBytes,
+	// so that the caller that loaded it can read it.
+	for s.nbytes > s.cacheBytes && s.lru.Len() > 1 {
+		s.lru.RemoveOldest()
+	}
+	return nil
+}
+
+// Remove removes the value for key and deletes its file.
+func (s *StreamStore) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Remove(key)
+}
+
+// Bytes returns the total size of the cached values.
+func (s *StreamStore) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nbytes
+}
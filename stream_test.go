@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamStore(t *testing.T) {
+	dir := t.TempDir()
+	var loads AtomicInt
+	s := NewStreamStore(dir, 10, StreamGetterFunc(func(key string, w io.Writer) error {
+		loads.Add(1)
+		_, err := io.WriteString(w, strings.Repeat(key, 6))
+		return err
+	}))
+
+	read := func(key string) string {
+		b, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		data, err := io.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != b.Len() {
+			t.Errorf("read %d bytes; Len = %d", len(data), b.Len())
+		}
+		return string(data)
+	}
+
+	if got := read("a"); got != "aaaaaa" {
+		t.Errorf("got %q; want %q", got, "aaaaaa")
+	}
+	read("a")
+	if n := loads.Get(); n != 1 {
+		t.Errorf("getter called %d times; want 1", n)
+	}
+
+	read("b")
+	if got := s.Bytes(); got != 6 {
+		t.Errorf("Bytes = %d after eviction; want 6", got)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("%d files left in store dir; want 1", len(files))
+	}
+
+	s.Remove("b")
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("file of removed value still exists: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package cache
+
+import "strings"
+
+// A SubStore is a view of a Store that transparently prefixes every
+// key with a fixed prefix. It shares the underlying cache, byte budget
+// and getter with its parent; the getter sees the prefixed key.
+type SubStore struct {
+	store  *Store
+	prefix string
+}
+
+// Sub returns a SubStore that prefixes keys with prefix.
+func (s *Store) Sub(prefix string) *SubStore {
+	return &SubStore{store: s, prefix: prefix}
+}
+
+// Prefix returns the prefix applied to keys.
+func (s *SubStore) Prefix() string {
+	return s.prefix
+}
+
+// Get is like Store.Get with key prefixed.
+func (s *SubStore) Get(key string, dest Sink) error {
+	return s.store.Get(s.prefix+key, dest)
+}
+
+// Set is like Store.Set with key prefixed.
+func (s *SubStore) Set(key string, value ByteView) {
+	s.store.Set(s.prefix+key, value)
+}
+
+// Remove is like Store.Remove with key prefixed.
+func (s *SubStore) Remove(key string) {
+	s.store.Remove(s.prefix + key)
+}
+
+// Keys returns the cached keys that start with the prefix, with the
+// prefix removed.
+func (s *SubStore) Keys() []string {
+	keys := s.store.keysWithPrefix(s.prefix)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+	return keys
+}
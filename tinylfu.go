@@ -0,0 +1,118 @@
+package cache
+
+import "sync"
+
+// An AdmissionPolicy chooses whether a store caches a new value.
+type AdmissionPolicy int
+
+const (
+	// AdmitAll caches every value.
+	AdmitAll AdmissionPolicy = iota
+
+	// PolicyTinyLFU caches a value that would cause an eviction only
+	// if its key is estimated to be requested more often than the key
+	// that would be evicted, so that keys seen once, as in a scan,
+	// don't push out hot ones. Frequencies are estimated by TinyLFU: a
+	// count-min sketch of recent requests behind a doorkeeper that
+	// keeps keys seen only once out of the sketch. It only applies to
+	// backends that can name their next victim without evicting it,
+	// such as the LRU.
+	PolicyTinyLFU
+)
+
+// tinyLFU estimates how often keys are requested. Counters saturate at
+// 15 and are halved, and the doorkeeper cleared, every sampleSize
+// increments, so that estimates follow recent popularity.
+type tinyLFU struct {
+	mu         sync.Mutex
+	rows       [4][]uint8
+	door       []uint64 // bloom filter of keys seen since the last reset
+	mask       uint64   // len of each row and of door's bits, minus 1
+	additions  int
+	sampleSize int
+}
+
+// newTinyLFU returns a tinyLFU sized for about n distinct keys.
+func newTinyLFU(n int) *tinyLFU {
+	width := 64
+	for width < n && width < 1<<24 {
+		width <<= 1
+	}
+	t := &tinyLFU{
+		door:       make([]uint64, width/64),
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range t.rows {
+		t.rows[i] = make([]uint8, width)
+	}
+	return t
+}
+
+// index returns the position of h in row i, by double hashing.
+func (t *tinyLFU) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|1)) & t.mask
+}
+
+func (t *tinyLFU) increment(key string) {
+	h := fnv64a(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.doorContains(h) {
+		t.doorAdd(h)
+	} else {
+		for i, row := range t.rows {
+			if j := t.index(h, i); row[j] < 15 {
+				row[j]++
+			}
+		}
+	}
+	t.additions++
+	if t.additions >= t.sampleSize {
+		t.reset()
+	}
+}
+
+func (t *tinyLFU) estimate(key string) int {
+	h := fnv64a(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	min := uint8(15)
+	for i, row := range t.rows {
+		if c := row[t.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	n := int(min)
+	if t.doorContains(h) {
+		n++
+	}
+	return n
+}
+
+func (t *tinyLFU) doorContains(h uint64) bool {
+	for _, j := range [2]uint64{h & t.mask, (h >> 32) & t.mask} {
+		if t.door[j/64]&(1<<(j%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tinyLFU) doorAdd(h uint64) {
+	for _, j := range [2]uint64{h & t.mask, (h >> 32) & t.mask} {
+		t.door[j/64] |= 1 << (j % 64)
+	}
+}
+
+func (t *tinyLFU) reset() {
+	for _, row := range t.rows {
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	for j := range t.door {
+		t.door[j] = 0
+	}
+	t.additions = 0
+}
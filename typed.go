@@ -0,0 +1,22 @@
+package cache
+
+// Get loads key from s and decodes its JSON value into a new T.
+func Get[T any](s *Store, key string) (T, error) {
+	var v T
+	sink := jsonSinkPool.Get().(*jsonSink)
+	sink.reset(&v)
+	err := s.Get(key, sink)
+	sink.reset(nil)
+	jsonSinkPool.Put(sink)
+	return v, err
+}
+
+// Set encodes v as JSON and stores it in s under key.
+func Set[T any](s *Store, key string, v T) error {
+	b, err := jsonMarshal(v)
+	if err != nil {
+		return err
+	}
+	s.Set(key, ByteView{b: b})
+	return nil
+}